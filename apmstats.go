@@ -0,0 +1,104 @@
+package doghouse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+//go:generate msgp
+
+const statsPath = "/v0.6/stats"
+
+// ClientStatsPayload is the msgpack document sent to /v0.6/stats by tracers that compute APM stats on the client.
+type ClientStatsPayload struct {
+	Hostname string
+	Env      string
+	Version  string
+	Stats    []ClientStatsBucket
+}
+
+// ClientStatsBucket holds the stats aggregated over a time bucket starting at Start and lasting Duration
+// nanoseconds.
+type ClientStatsBucket struct {
+	Start    uint64
+	Duration uint64
+	Stats    []ClientGroupedStats
+}
+
+// ClientGroupedStats are the stats for a single aggregation key within a bucket.
+type ClientGroupedStats struct {
+	Service        string
+	Name           string
+	Resource       string
+	HTTPStatusCode uint32
+	Type           string
+	DBType         string
+	Hits           uint64
+	Errors         uint64
+	Duration       uint64
+	OkSummary      []byte
+	ErrorSummary   []byte
+	Synthetics     bool
+	TopLevelHits   uint64
+}
+
+// serveStats decodes and records a stats payload. Payloads that cannot be decoded are reported like any other
+// decode error.
+func (s *MockDatadogServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.decodeFailed(fmt.Errorf("failed to get stats body: %w", err), nil)
+		return
+	}
+
+	var payload ClientStatsPayload
+	if _, err := payload.UnmarshalMsg(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.decodeFailed(fmt.Errorf("failed to parse stats: %w", err), body)
+		return
+	}
+
+	s.lock.Lock()
+	s.clientStats = append(s.clientStats, payload)
+	s.lock.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ReceivedStats returns every stats payload received, in the order they arrived. The tracer only computes stats
+// when stats computation is enabled, e.g. with tracer.WithStatsComputation(true).
+func (s *MockDatadogServer) ReceivedStats() []ClientStatsPayload {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]ClientStatsPayload(nil), s.clientStats...)
+}
+
+// ExpectStatsFor ensures that stats were received for the given service and resource.
+func (s *MockDatadogServer) ExpectStatsFor(t testing.TB, service, resource string) {
+	t.Helper()
+
+	if err := s.CheckStatsFor(service, resource); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckStatsFor returns an error unless a received stats bucket aggregates hits for the given service and
+// resource.
+func (s *MockDatadogServer) CheckStatsFor(service, resource string) error {
+	found := []string{}
+	for _, payload := range s.ReceivedStats() {
+		for _, bucket := range payload.Stats {
+			for _, stats := range bucket.Stats {
+				if stats.Service == service && stats.Resource == resource && stats.Hits > 0 {
+					return nil
+				}
+				found = append(found, fmt.Sprintf("%s/%s", stats.Service, stats.Resource))
+			}
+		}
+	}
+	return fmt.Errorf("no stats found for service %q and resource %q, found stats for: %v", service, resource, found)
+}
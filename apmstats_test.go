@@ -0,0 +1,63 @@
+package doghouse
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReceivedStats(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging(), WithStrictPaths())
+
+	post := func(body []byte) int {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, statsPath, bytes.NewReader(body)))
+		return recorder.Code
+	}
+
+	payload := ClientStatsPayload{
+		Hostname: "host",
+		Env:      "test",
+		Stats: []ClientStatsBucket{{
+			Start:    1,
+			Duration: 10,
+			Stats: []ClientGroupedStats{
+				{Service: "web", Name: "http.request", Resource: "GET /users", Hits: 3, Errors: 1, Duration: 30},
+				{Service: "db", Name: "query", Resource: "SELECT", Hits: 0},
+			},
+		}},
+	}
+	body, err := payload.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("failed to encode stats: %v", err)
+	}
+	if code := post(body); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := post([]byte("not msgpack")); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status for invalid stats %d", code)
+	}
+	if len(s.DecodeErrors()) != 1 {
+		t.Fatalf("expected invalid stats to be recorded as a decode error, got %v", s.DecodeErrors())
+	}
+
+	stats := s.ReceivedStats()
+	if len(stats) != 1 || stats[0].Env != "test" || stats[0].Stats[0].Stats[0].Hits != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	s.ExpectStatsFor(t, "web", "GET /users")
+	if err := s.CheckStatsFor("db", "SELECT"); err == nil {
+		t.Fatal("expected stats without hits to fail")
+	}
+	if err := s.CheckStatsFor("web", "POST /users"); err == nil || !strings.Contains(err.Error(), "web/GET /users") {
+		t.Fatalf("expected missing stats to fail, got %v", err)
+	}
+
+	s.Reset()
+	if len(s.ReceivedStats()) != 0 {
+		t.Fatal("expected stats to be cleared by reset")
+	}
+}
@@ -0,0 +1,1570 @@
+package doghouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+)
+
+// pendingError is returned from a wait expectation that has not been met yet but may be met once
+// more spans are received.
+type pendingError struct {
+	err error
+}
+
+func (e *pendingError) Error() string {
+	return e.err.Error()
+}
+
+// pending formats a pendingError.
+func pending(format string, args ...interface{}) error {
+	return &pendingError{err: fmt.Errorf(format, args...)}
+}
+
+// waitUntil blocks until the expectation returns something other than a pendingError. The expectation is checked
+// under the read lock immediately, every time new spans are stored, and at the configured poll interval. If the
+// context is done first, the last pending error is returned wrapping the context error.
+func (s *MockDatadogServer) waitUntil(ctx context.Context, expectation func() error) error {
+	done := false
+	stop := context.AfterFunc(ctx, func() {
+		// taking the write lock ensures a waiter is either blocked in Wait or will see done
+		s.lock.Lock()
+		done = true
+		s.lock.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+
+	if s.pollInterval > 0 {
+		ticker := s.clock.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+
+		finished := make(chan struct{})
+		defer close(finished)
+
+		go func() {
+			for {
+				select {
+				case <-finished:
+					return
+				case <-ticker.C():
+					s.cond.Broadcast()
+				}
+			}
+		}()
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for {
+		err := expectation()
+		var p *pendingError
+		if !errors.As(err, &p) {
+			return err
+		}
+		if done {
+			return fmt.Errorf("%w: %w", p.err, context.Cause(ctx))
+		}
+		s.cond.Wait()
+	}
+}
+
+// checkParents verifies that the ancestors of the given span match the named parents in order. Walking back to a
+// span that has already been visited is reported as a cycle rather than matching the same spans again.
+func (s *MockDatadogServer) checkParents(span Span, parents []string) error {
+	current := span
+	visited := map[uint64]struct{}{span.SpanID: {}}
+	for _, parent := range parents {
+		p, ok := s.spans.ByID(current.ParentID)
+		if !ok {
+			return fmt.Errorf("parent span for %q not found, parent id %d was never received", current.Name, current.ParentID)
+		}
+		if _, ok := visited[p.SpanID]; ok {
+			return fmt.Errorf("parent cycle detected walking up from %q, span %q with id %d was already visited", span.Name, p.Name, p.SpanID)
+		}
+		visited[p.SpanID] = struct{}{}
+		if p.Name != parent {
+			return fmt.Errorf("parent span %q did not match expected span %q", p.Name, parent)
+		}
+		current = p
+	}
+	return nil
+}
+
+// findSpanWithParents returns an error unless a span with the given name and parents has been received. The
+// boolean return value reports whether any span with the given name was found at all.
+func (s *MockDatadogServer) findSpanWithParents(name string, parents []string) (bool, error) {
+	_, found, err := s.matchSpanWithParents(name, parents)
+	return found, err
+}
+
+// matchSpanWithParents is findSpanWithParents that also returns the earliest received span that matched.
+func (s *MockDatadogServer) matchSpanWithParents(name string, parents []string) (Span, bool, error) {
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return Span{}, false, nil
+	}
+
+	var err error
+	for _, span := range spans {
+		if err = s.checkParents(span, parents); err == nil {
+			return span, true, nil
+		}
+	}
+	return Span{}, true, err
+}
+
+// matchSpan returns nil if any span with the given name passes the check, otherwise it returns the error produced
+// by checking the most recently received span with that name.
+func (s *MockDatadogServer) matchSpan(name string, check func(span Span) error) error {
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+	}
+
+	var err error
+	for _, span := range spans {
+		if err = check(span); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// WaitForSpan waits the default wait timeout, 10 milliseconds unless set with WithDefaultWaitTimeout, for the server
+// to receive the named span with optional parent matching.
+func (s *MockDatadogServer) WaitForSpan(t testing.TB, name string, parents ...string) {
+	t.Helper()
+
+	s.WaitDurationForSpan(t, s.waitTimeout, name, parents...)
+}
+
+// WaitDurationForSpan waits a specified duration for the server to receive the named span with optional parent
+// matching.
+func (s *MockDatadogServer) WaitDurationForSpan(t testing.TB, duration time.Duration, name string, parents ...string) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(duration)
+	defer cancel()
+
+	s.WaitForSpanContext(ctx, t, name, parents...)
+}
+
+// WaitForSpanContext waits until the server receives the named span with optional parent matching or the context
+// is done.
+func (s *MockDatadogServer) WaitForSpanContext(ctx context.Context, t testing.TB, name string, parents ...string) {
+	t.Helper()
+
+	if err := s.AwaitSpan(ctx, name, parents...); err != nil {
+		t.Fatalf("%v\nreceived traces:\n%s", err, s.Dump())
+	}
+}
+
+// AwaitSpan waits until the server receives the named span with optional parent matching. It returns an error if
+// the context is done first or if the named span is received with parents that do not match.
+func (s *MockDatadogServer) AwaitSpan(ctx context.Context, name string, parents ...string) error {
+	return s.waitUntil(ctx, func() error {
+		found, err := s.findSpanWithParents(name, parents)
+		if !found {
+			return pending("unable to find span %q", name)
+		}
+		return err
+	})
+}
+
+// WaitAndGetSpan waits the default wait timeout for the server to receive the named span with optional parent
+// matching and returns a copy of it, so that its fields can be inspected without a separate lookup.
+func (s *MockDatadogServer) WaitAndGetSpan(t testing.TB, name string, parents ...string) Span {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(s.waitTimeout)
+	defer cancel()
+
+	span, err := s.AwaitAndGetSpan(ctx, name, parents...)
+	if err != nil {
+		t.Fatalf("%v\nreceived traces:\n%s", err, s.Dump())
+	}
+	return span
+}
+
+// AwaitAndGetSpan waits like AwaitSpan and returns a copy of the earliest received span that matched. The span is
+// captured at the moment the expectation is met, so spans received afterwards cannot change the result.
+func (s *MockDatadogServer) AwaitAndGetSpan(ctx context.Context, name string, parents ...string) (Span, error) {
+	var span Span
+	err := s.waitUntil(ctx, func() error {
+		matched, found, err := s.matchSpanWithParents(name, parents)
+		if !found {
+			return pending("unable to find span %q", name)
+		}
+		span = copySpan(matched)
+		return err
+	})
+	return span, err
+}
+
+// WaitForSpans waits a specified duration for the server to receive every named span, failing with the names of
+// the spans that are still missing if any have not arrived in time.
+func (s *MockDatadogServer) WaitForSpans(t testing.TB, duration time.Duration, names ...string) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(duration)
+	defer cancel()
+
+	if err := s.AwaitSpans(ctx, names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitSpans waits until the server receives every named span, returning an error listing the missing spans if the
+// context is done first.
+func (s *MockDatadogServer) AwaitSpans(ctx context.Context, names ...string) error {
+	return s.waitUntil(ctx, func() error {
+		missing := []string{}
+		for _, name := range names {
+			if !s.hasSpan(name) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return pending("still missing spans %v, received spans: %v", missing, s.spanNames())
+		}
+		return nil
+	})
+}
+
+// WaitForSpanWithMeta waits the default wait timeout for the server to receive a span with the given name and every
+// key and value in meta present in its Meta tags. This is useful when tags are attached by a later partial flush or
+// when waiting for one variant of a repeated span. On timeout the meta of the closest matching span is reported.
+func (s *MockDatadogServer) WaitForSpanWithMeta(t testing.TB, name string, meta map[string]string) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(s.waitTimeout)
+	defer cancel()
+
+	if err := s.AwaitSpanWithMeta(ctx, name, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitSpanWithMeta waits until the server receives a span with the given name and every key and value in meta
+// present in its Meta tags, returning an error describing the closest matching span if the context is done first.
+// The closest match is the span with the fewest missing or mismatched tags, preferring the most recently received.
+func (s *MockDatadogServer) AwaitSpanWithMeta(ctx context.Context, name string, meta map[string]string) error {
+	return s.waitUntil(ctx, func() error {
+		spans := s.spans.ByName(name)
+		if len(spans) == 0 {
+			return pending("unable to find span %q in spans: %v", name, s.spanNames())
+		}
+
+		var closest Span
+		var closestProblems []string
+		for _, span := range spans {
+			problems := tagProblems(span, meta)
+			if len(problems) == 0 {
+				return nil
+			}
+			if closestProblems == nil || len(problems) <= len(closestProblems) {
+				closest, closestProblems = span, problems
+			}
+		}
+		sort.Strings(closestProblems)
+		return pending("span named %q with meta %v not found, closest match had meta %v: %s", name, meta, closest.Meta, strings.Join(closestProblems, ", "))
+	})
+}
+
+// WaitForTrace waits up to the timeout for a root span with the given name to be received along with the rest of
+// its trace, returning every span sharing the root's 128-bit trace ID sorted by Start. Since partial flushing can
+// split a trace across batches, the trace is only returned once no new spans have arrived for it for a short settle
+// period.
+func (s *MockDatadogServer) WaitForTrace(t testing.TB, rootName string, timeout time.Duration) []Span {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(timeout)
+	defer cancel()
+
+	spans, err := s.AwaitTrace(ctx, rootName)
+	if err != nil {
+		t.Fatalf("%v\nreceived traces:\n%s", err, s.Dump())
+	}
+	return spans
+}
+
+// AwaitTrace waits until a root span with the given name is received and its trace has settled, returning the
+// trace as WaitForTrace does. If the context is done first, an error is returned along with any spans received for
+// the trace so far.
+func (s *MockDatadogServer) AwaitTrace(ctx context.Context, rootName string) ([]Span, error) {
+	var root Span
+	err := s.waitUntil(ctx, func() error {
+		for _, span := range s.spans.ByName(rootName) {
+			if span.ParentID == 0 {
+				root = span
+				return nil
+			}
+		}
+		return pending("unable to find root span %q in spans: %v", rootName, s.spanNames())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	traceID := s.spanTraceID(root)
+	s.lock.RUnlock()
+
+	spans := s.GetTrace(traceID)
+	for {
+		select {
+		case <-ctx.Done():
+			return spans, fmt.Errorf("trace %s of root span %q still receiving spans, %d received: %w", traceID, rootName, len(spans), context.Cause(ctx))
+		case <-s.clock.After(traceSettlePeriod):
+		}
+		settled := s.GetTrace(traceID)
+		if len(settled) == len(spans) {
+			return settled, nil
+		}
+		spans = settled
+	}
+}
+
+// WaitForSpanMatching waits the default wait timeout for the server to receive a span with a name matching the pattern.
+func (s *MockDatadogServer) WaitForSpanMatching(t testing.TB, pattern *regexp.Regexp) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(s.waitTimeout)
+	defer cancel()
+
+	if err := s.AwaitSpanMatching(ctx, pattern); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitSpanMatching waits until the server receives a span with a name matching the pattern, returning an error
+// if the context is done first.
+func (s *MockDatadogServer) AwaitSpanMatching(ctx context.Context, pattern *regexp.Regexp) error {
+	return s.waitUntil(ctx, func() error {
+		for _, span := range s.spans.All() {
+			if pattern.MatchString(span.Name) {
+				return nil
+			}
+		}
+		return pending("unable to find span matching %q in spans: %v", pattern, s.spanNames())
+	})
+}
+
+// WaitForSpanCount waits the default wait timeout for the server to receive exactly count spans with the given name.
+func (s *MockDatadogServer) WaitForSpanCount(t testing.TB, name string, count int) {
+	t.Helper()
+
+	s.WaitDurationForSpanCount(t, s.waitTimeout, name, count)
+}
+
+// WaitDurationForSpanCount waits a specified duration for the server to receive exactly count spans with the given
+// name.
+func (s *MockDatadogServer) WaitDurationForSpanCount(t testing.TB, duration time.Duration, name string, count int) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(duration)
+	defer cancel()
+
+	if err := s.AwaitSpanCount(ctx, name, count); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitSpanCount waits until the server receives exactly count spans with the given name, returning an error if
+// the context is done first.
+func (s *MockDatadogServer) AwaitSpanCount(ctx context.Context, name string, count int) error {
+	return s.waitUntil(ctx, func() error {
+		if err := s.checkSpanCount(name, count); err != nil {
+			return &pendingError{err: err}
+		}
+		return nil
+	})
+}
+
+// WaitForQuiescence waits until no new span has been received for the quiet duration, failing if the timeout
+// elapses first.
+func (s *MockDatadogServer) WaitForQuiescence(t testing.TB, quiet, timeout time.Duration) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(timeout)
+	defer cancel()
+
+	if err := s.AwaitQuiescence(ctx, quiet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitQuiescence waits until no new span has been received for the quiet duration, returning an error if the
+// context is done first. Only spans received after the call count, so the server must be quiet for the full
+// duration even if nothing was received beforehand.
+func (s *MockDatadogServer) AwaitQuiescence(ctx context.Context, quiet time.Duration) error {
+	start := s.clock.Now()
+	for {
+		s.lock.RLock()
+		last := s.lastSpanTime
+		s.lock.RUnlock()
+
+		if last.Before(start) {
+			last = start
+		}
+		remaining := quiet - s.clock.Now().Sub(last)
+		if remaining <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("spans still being received, last at %v: %w", last.Format(time.RFC3339Nano), context.Cause(ctx))
+		case <-s.clock.After(remaining):
+		}
+	}
+}
+
+// ExpectNoSpan ensures that the named span is not received within the default no span timeout, 100 milliseconds
+// unless set with WithDefaultNoSpanTimeout.
+func (s *MockDatadogServer) ExpectNoSpan(t testing.TB, name string) {
+	t.Helper()
+
+	s.ExpectDurationNoSpan(t, s.noSpanTimeout, name)
+}
+
+// ExpectDurationNoSpan ensures that the named span is not received within the given duration. The full duration
+// is the window in which the span must be absent, so the happy path always waits for the entire duration while a
+// failure is reported as soon as the span arrives.
+func (s *MockDatadogServer) ExpectDurationNoSpan(t testing.TB, duration time.Duration, name string) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(duration)
+	defer cancel()
+
+	if err := s.AwaitNoSpan(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitNoSpan waits until the context is done, returning an error as soon as the named span is received.
+func (s *MockDatadogServer) AwaitNoSpan(ctx context.Context, name string) error {
+	err := s.waitUntil(ctx, func() error {
+		if !s.hasSpan(name) {
+			return pending("span %q not found", name)
+		}
+		return nil
+	})
+	if err == nil {
+		return fmt.Errorf("unexpected span %q found", name)
+	}
+	return nil
+}
+
+// HasSpan reports whether a span with the given name has been received.
+func (s *MockDatadogServer) HasSpan(name string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.hasSpan(name)
+}
+
+func (s *MockDatadogServer) hasSpan(name string) bool {
+	return len(s.spans.ByName(name)) > 0
+}
+
+// HasSpanWithParents reports whether a span with the given name and parents has been received, using the same
+// parent walk as ExpectSpan without failing the test.
+func (s *MockDatadogServer) HasSpanWithParents(name string, parents ...string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	found, err := s.findSpanWithParents(name, parents)
+	return found && err == nil
+}
+
+// FindSpan returns the most recently received span with the given name or an error if no such span exists.
+func (s *MockDatadogServer) FindSpan(name string) (Span, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return Span{}, fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+	}
+	return spans[len(spans)-1], nil
+}
+
+// Expect a named span with the given optional parents to have been received.
+func (s *MockDatadogServer) ExpectSpan(t testing.TB, name string, parents ...string) {
+	t.Helper()
+
+	if err := s.CheckSpan(name, parents...); err != nil {
+		t.Fatalf("%v\nreceived traces:\n%s", err, s.Dump())
+	}
+}
+
+// CheckSpan returns an error unless a named span with the given optional parents has been received.
+func (s *MockDatadogServer) CheckSpan(name string, parents ...string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	found, err := s.findSpanWithParents(name, parents)
+	if !found {
+		return fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+	}
+	return err
+}
+
+// ExpectSpanByID ensures that a span with the given span ID was received.
+func (s *MockDatadogServer) ExpectSpanByID(t testing.TB, id uint64) {
+	t.Helper()
+
+	if err := s.CheckSpanByID(id); err != nil {
+		t.Fatalf("%v\nreceived traces:\n%s", err, s.Dump())
+	}
+}
+
+// CheckSpanByID returns an error unless a span with the given span ID has been received.
+func (s *MockDatadogServer) CheckSpanByID(id uint64) error {
+	if _, ok := s.GetSpanByID(id); !ok {
+		return fmt.Errorf("span with id %d not found", id)
+	}
+	return nil
+}
+
+// ExpectSpanDescendsFrom ensures that a span with the given name was received with a span named ancestorName
+// anywhere in its chain of parents, regardless of the spans in between.
+func (s *MockDatadogServer) ExpectSpanDescendsFrom(t testing.TB, name, ancestorName string) {
+	t.Helper()
+
+	if err := s.CheckSpanDescendsFrom(name, ancestorName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanDescendsFrom returns an error including the actual chain of parents unless a span with the given name
+// was received with a span named ancestorName among its ancestors. The walk stops at a parent that was never
+// received or that would form a cycle.
+func (s *MockDatadogServer) CheckSpanDescendsFrom(name, ancestorName string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		chain := s.ancestors(span)
+		names := make([]string, 0, len(chain))
+		for i, ancestor := range chain {
+			if i > 0 && ancestor.Name == ancestorName {
+				return nil
+			}
+			names = append(names, ancestor.Name)
+		}
+		return fmt.Errorf("span named %q does not descend from %q, ancestors: %s", name, ancestorName, strings.Join(names, " -> "))
+	})
+}
+
+// Expect a named span with the given verification function to exist. If multiple spans share the name, at least
+// one of them must pass the verification function.
+func (s *MockDatadogServer) ExpectSpanFn(t testing.TB, name string, fn func(span Span) bool, msg string, args ...interface{}) {
+	t.Helper()
+
+	if err := s.CheckSpanFn(name, fn, msg, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanFn returns an error unless a named span passing the verification function has been received. The
+// message and arguments are formatted into the error returned when no span passes.
+func (s *MockDatadogServer) CheckSpanFn(name string, fn func(span Span) bool, msg string, args ...interface{}) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		if !fn(span) {
+			return fmt.Errorf(msg, args...)
+		}
+		return nil
+	})
+}
+
+// ExpectSpanCount ensures that exactly count spans with the given name have been received.
+func (s *MockDatadogServer) ExpectSpanCount(t testing.TB, name string, count int) {
+	t.Helper()
+
+	if err := s.CheckSpanCount(name, count); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanCount returns an error unless exactly count spans with the given name have been received.
+func (s *MockDatadogServer) CheckSpanCount(name string, count int) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.checkSpanCount(name, count)
+}
+
+func (s *MockDatadogServer) checkSpanCount(name string, count int) error {
+	if actual := len(s.spans.ByName(name)); actual != count {
+		return fmt.Errorf("expected %d spans named %q, found %d in spans: %v", count, name, actual, s.spanNames())
+	}
+	return nil
+}
+
+// ExpectSpanWithService ensures that a span with the given name was received for the given service.
+func (s *MockDatadogServer) ExpectSpanWithService(t testing.TB, name, service string) {
+	t.Helper()
+
+	if err := s.CheckSpanWithService(name, service); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanWithService returns an error unless a span with the given name was received for the given service.
+func (s *MockDatadogServer) CheckSpanWithService(name, service string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+	}
+
+	services := []string{}
+	for _, span := range spans {
+		if span.Service == service {
+			return nil
+		}
+		services = append(services, span.Service)
+	}
+	return fmt.Errorf("span named %q not found for service %q, found services: %v", name, service, services)
+}
+
+// ExpectNoSpansForService ensures that no span was received for the given service, such as one whose tracing has
+// been disabled.
+func (s *MockDatadogServer) ExpectNoSpansForService(t testing.TB, service string) {
+	t.Helper()
+
+	if err := s.CheckNoSpansForService(service); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckNoSpansForService returns an error listing the names of the offending spans if any span was received for the
+// given service.
+func (s *MockDatadogServer) CheckNoSpansForService(service string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spansByService[service]
+	if len(spans) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	return fmt.Errorf("expected no spans for service %q, found %d: %v", service, len(spans), names)
+}
+
+// ExpectSpanMeta ensures that a span with the given name was received with every key and value in meta present
+// in its Meta tags. Additional tags on the span are ignored.
+func (s *MockDatadogServer) ExpectSpanMeta(t testing.TB, name string, meta map[string]string) {
+	t.Helper()
+
+	if err := s.CheckSpanMeta(name, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanMeta returns an error unless a span with the given name was received with every key and value in meta
+// present in its Meta tags.
+func (s *MockDatadogServer) CheckSpanMeta(name string, meta map[string]string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		missing := []string{}
+		mismatched := []string{}
+		for key, expected := range meta {
+			actual, ok := span.Meta[key]
+			if !ok {
+				missing = append(missing, key)
+				continue
+			}
+			if actual != expected {
+				mismatched = append(mismatched, fmt.Sprintf("%s: expected %q, got %q", key, expected, actual))
+			}
+		}
+		if len(missing) == 0 && len(mismatched) == 0 {
+			return nil
+		}
+		sort.Strings(missing)
+		sort.Strings(mismatched)
+		return fmt.Errorf("span named %q meta did not match, missing keys: %v, mismatched values: %v", name, missing, mismatched)
+	})
+}
+
+// ExpectSpanMetric ensures that a span with the given name was received with the metric key within tolerance of
+// the given value.
+func (s *MockDatadogServer) ExpectSpanMetric(t testing.TB, name, key string, value, tolerance float64) {
+	t.Helper()
+
+	if err := s.CheckSpanMetric(name, key, value, tolerance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanMetric returns an error unless a span with the given name was received with the metric key within
+// tolerance of the given value.
+func (s *MockDatadogServer) CheckSpanMetric(name, key string, value, tolerance float64) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		actual, ok := span.Metrics[key]
+		if !ok {
+			return fmt.Errorf("span named %q missing metric %q", name, key)
+		}
+		if math.Abs(actual-value) > tolerance {
+			return fmt.Errorf("span named %q metric %q was %v, expected %v within tolerance %v", name, key, actual, value, tolerance)
+		}
+		return nil
+	})
+}
+
+// ExpectSpanType ensures that a span with the given name was received with the given Type, such as web or sql.
+func (s *MockDatadogServer) ExpectSpanType(t testing.TB, name, spanType string) {
+	t.Helper()
+
+	if err := s.CheckSpanType(name, spanType); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanType returns an error unless a span with the given name was received with the given Type.
+func (s *MockDatadogServer) CheckSpanType(name, spanType string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		if span.Type != spanType {
+			return fmt.Errorf("span named %q has type %q, expected %q", name, span.Type, spanType)
+		}
+		return nil
+	})
+}
+
+// ExpectSpanKind ensures that a span with the given name was received with the given span.kind meta tag, such as
+// server or client.
+func (s *MockDatadogServer) ExpectSpanKind(t testing.TB, name, kind string) {
+	t.Helper()
+
+	if err := s.CheckSpanKind(name, kind); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanKind returns an error unless a span with the given name was received with the given span.kind meta tag.
+func (s *MockDatadogServer) CheckSpanKind(name, kind string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		actual, ok := span.Meta[ext.SpanKind]
+		if !ok {
+			return fmt.Errorf("span named %q has no %s tag, expected %q", name, ext.SpanKind, kind)
+		}
+		if actual != kind {
+			return fmt.Errorf("span named %q has %s %q, expected %q", name, ext.SpanKind, actual, kind)
+		}
+		return nil
+	})
+}
+
+// ExpectSpanEnv ensures that a span with the given name was received with the given env unified service tag.
+func (s *MockDatadogServer) ExpectSpanEnv(t testing.TB, name, env string) {
+	t.Helper()
+
+	if err := s.CheckSpanEnv(name, env); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanEnv returns an error unless a span with the given name was received with the given env meta tag, or
+// _dd.env if env is not set.
+func (s *MockDatadogServer) CheckSpanEnv(name, env string) error {
+	return s.checkUnifiedTag(name, ext.Environment, env)
+}
+
+// ExpectSpanVersion ensures that a span with the given name was received with the given version unified service
+// tag.
+func (s *MockDatadogServer) ExpectSpanVersion(t testing.TB, name, version string) {
+	t.Helper()
+
+	if err := s.CheckSpanVersion(name, version); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanVersion returns an error unless a span with the given name was received with the given version meta
+// tag, or _dd.version if version is not set.
+func (s *MockDatadogServer) CheckSpanVersion(name, version string) error {
+	return s.checkUnifiedTag(name, ext.Version, version)
+}
+
+// checkUnifiedTag returns an error unless a span with the given name has the unified service tag set to value,
+// falling back to the _dd. prefixed form of the tag.
+func (s *MockDatadogServer) checkUnifiedTag(name, key, value string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		actual, ok := span.Meta[key]
+		if !ok {
+			actual, ok = span.Meta["_dd."+key]
+		}
+		if !ok {
+			return fmt.Errorf("span named %q has no %s tag, expected %q", name, key, value)
+		}
+		if actual != value {
+			return fmt.Errorf("span named %q has %s %q, expected %q", name, key, actual, value)
+		}
+		return nil
+	})
+}
+
+// ExpectHTTPSpan ensures that a span with the given name was received with the standard web tags: http.method
+// and http.route matching, http.status_code matching status, and http.url present.
+func (s *MockDatadogServer) ExpectHTTPSpan(t testing.TB, name string, method, route string, status int) {
+	t.Helper()
+
+	if err := s.CheckHTTPSpan(name, method, route, status); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckHTTPSpan returns an error unless a span with the given name was received with the standard web tags. The
+// error lists every tag that did not match.
+func (s *MockDatadogServer) CheckHTTPSpan(name string, method, route string, status int) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		problems := tagProblems(span, map[string]string{
+			ext.HTTPMethod: method,
+			ext.HTTPRoute:  route,
+			ext.HTTPCode:   strconv.Itoa(status),
+		})
+		if _, ok := span.Meta[ext.HTTPURL]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing", ext.HTTPURL))
+		}
+		if len(problems) == 0 {
+			return nil
+		}
+		sort.Strings(problems)
+		return fmt.Errorf("span named %q is not the expected http span: %s", name, strings.Join(problems, ", "))
+	})
+}
+
+// ExpectDBSpan ensures that a span with the given name was received with the standard database contract: Type
+// sql, db.type matching dbType, db.instance present, and the statement in either sql.query or db.statement.
+func (s *MockDatadogServer) ExpectDBSpan(t testing.TB, name string, dbType, statement string) {
+	t.Helper()
+
+	if err := s.CheckDBSpan(name, dbType, statement); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckDBSpan returns an error unless a span with the given name was received with the standard database
+// contract. The error lists every part of the contract that did not match.
+func (s *MockDatadogServer) CheckDBSpan(name string, dbType, statement string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		problems := tagProblems(span, map[string]string{ext.DBType: dbType})
+		if _, ok := span.Meta[ext.DBInstance]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing", ext.DBInstance))
+		}
+		if span.Type != ext.SpanTypeSQL {
+			problems = append(problems, fmt.Sprintf("type: expected %q, got %q", ext.SpanTypeSQL, span.Type))
+		}
+		if problem := statementProblem(span, statement); problem != "" {
+			problems = append(problems, problem)
+		}
+		if len(problems) == 0 {
+			return nil
+		}
+		sort.Strings(problems)
+		return fmt.Errorf("span named %q is not the expected database span: %s", name, strings.Join(problems, ", "))
+	})
+}
+
+// defaultNormalizationPattern matches the values that obfuscation is expected to replace in a resource: single
+// quoted string literals and standalone numbers. Double quoted strings are left alone since SQL uses them for
+// identifiers.
+var defaultNormalizationPattern = regexp.MustCompile(`'[^']*'|\b\d+(\.\d+)?\b`)
+
+// ExpectResourceNormalized ensures that spans with the given name were received and that none of their resources
+// contain literal values that suggest they were not obfuscated, such as WHERE id = 42 rather than WHERE id = ?.
+// Literals are matched with a pattern that can be replaced with WithNormalizationPattern.
+func (s *MockDatadogServer) ExpectResourceNormalized(t testing.TB, name string) {
+	t.Helper()
+
+	if err := s.CheckResourceNormalized(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckResourceNormalized returns an error listing the offending resources unless spans with the given name were
+// received and none of their resources match the normalization pattern.
+func (s *MockDatadogServer) CheckResourceNormalized(name string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+	}
+
+	offending := []string{}
+	for _, span := range spans {
+		if literal := s.normalizationPattern.FindString(span.Resource); literal != "" {
+			offending = append(offending, fmt.Sprintf("%q contains %q", span.Resource, literal))
+		}
+	}
+	if len(offending) > 0 {
+		return fmt.Errorf("span named %q has resources that are not normalized: %s", name, strings.Join(offending, ", "))
+	}
+	return nil
+}
+
+// statementProblem describes why the span's statement, which integrations record under either sql.query or
+// db.statement, does not match the expected one or returns an empty string if it does.
+func statementProblem(span Span, statement string) string {
+	actual := []string{}
+	for _, key := range []string{ext.SQLQuery, ext.DBStatement} {
+		value, ok := span.Meta[key]
+		if !ok {
+			continue
+		}
+		if value == statement {
+			return ""
+		}
+		actual = append(actual, fmt.Sprintf("%s %q", key, value))
+	}
+	if len(actual) == 0 {
+		return fmt.Sprintf("statement: missing, expected %q in %s or %s", statement, ext.SQLQuery, ext.DBStatement)
+	}
+	return fmt.Sprintf("statement: expected %q, got %s", statement, strings.Join(actual, " and "))
+}
+
+// tagProblems describes every key in expected that is missing from or has a different value in the span's Meta.
+func tagProblems(span Span, expected map[string]string) []string {
+	problems := []string{}
+	for key, value := range expected {
+		actual, ok := span.Meta[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing, expected %q", key, value))
+			continue
+		}
+		if actual != value {
+			problems = append(problems, fmt.Sprintf("%s: expected %q, got %q", key, value, actual))
+		}
+	}
+	return problems
+}
+
+// ExpectSamplingPriority ensures that a span with the given name was received with the given sampling priority
+// recorded in its _sampling_priority_v1 metric.
+func (s *MockDatadogServer) ExpectSamplingPriority(t testing.TB, name string, priority int) {
+	t.Helper()
+
+	if err := s.CheckSamplingPriority(name, priority); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSamplingPriority returns an error unless a span with the given name was received with the given sampling
+// priority.
+func (s *MockDatadogServer) CheckSamplingPriority(name string, priority int) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		actual, ok := span.Metrics[priorityMetric]
+		if !ok {
+			return fmt.Errorf("span named %q missing sampling priority metric %q", name, priorityMetric)
+		}
+		if int(actual) != priority {
+			return fmt.Errorf("span named %q has sampling priority %v, expected %d", name, actual, priority)
+		}
+		return nil
+	})
+}
+
+// ExpectSpanDuration ensures that a span with the given name was received with a duration within [min, max].
+func (s *MockDatadogServer) ExpectSpanDuration(t testing.TB, name string, min, max time.Duration) {
+	t.Helper()
+
+	if err := s.CheckSpanDuration(name, min, max); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanDuration returns an error unless a span with the given name was received with a duration within
+// [min, max].
+func (s *MockDatadogServer) CheckSpanDuration(name string, min, max time.Duration) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		if actual := time.Duration(span.Duration); actual < min || actual > max {
+			return fmt.Errorf("span named %q had duration %v, expected between %v and %v", name, actual, min, max)
+		}
+		return nil
+	})
+}
+
+// ExpectRootSpan ensures that a span with the given name was received without a parent.
+func (s *MockDatadogServer) ExpectRootSpan(t testing.TB, name string) {
+	t.Helper()
+
+	if err := s.CheckRootSpan(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckRootSpan returns an error unless a span with the given name was received without a parent.
+func (s *MockDatadogServer) CheckRootSpan(name string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		if span.ParentID == 0 {
+			return nil
+		}
+		if parent, ok := s.spans.ByID(span.ParentID); ok {
+			return fmt.Errorf("span named %q is not a root, it has parent %q", name, parent.Name)
+		}
+		return fmt.Errorf("span named %q is not a root, it has parent id %d which was not received", name, span.ParentID)
+	})
+}
+
+// ExpectLeafSpan ensures that a span with the given name was received without any children.
+func (s *MockDatadogServer) ExpectLeafSpan(t testing.TB, name string) {
+	t.Helper()
+
+	if err := s.CheckLeafSpan(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckLeafSpan returns an error unless a span with the given name was received without any children.
+func (s *MockDatadogServer) CheckLeafSpan(name string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		children := []string{}
+		for _, child := range s.childrenByParent[span.SpanID] {
+			if child.SpanID != span.SpanID {
+				children = append(children, child.Name)
+			}
+		}
+		if len(children) > 0 {
+			sort.Strings(children)
+			return fmt.Errorf("span named %q is not a leaf, it has children: %v", name, children)
+		}
+		return nil
+	})
+}
+
+// ExpectNoOrphans ensures that the parent of every received span with a parent was also received.
+func (s *MockDatadogServer) ExpectNoOrphans(t testing.TB) {
+	t.Helper()
+
+	if err := s.CheckNoOrphans(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckNoOrphans returns an error listing every received span whose parent was never received.
+func (s *MockDatadogServer) CheckNoOrphans() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	orphans := s.orphans()
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	descriptions := make([]string, 0, len(orphans))
+	for _, span := range orphans {
+		descriptions = append(descriptions, fmt.Sprintf("%q (span id %d, missing parent id %d)", span.Name, span.SpanID, span.ParentID))
+	}
+	return fmt.Errorf("found %d spans whose parents were never received: %s", len(orphans), strings.Join(descriptions, ", "))
+}
+
+// ExpectValidTrace ensures that the trace with the given 128-bit trace ID, as returned by FullTraceID, has exactly
+// one root, a span without a parent in the trace, and that following the parents of every span terminates at that
+// root without a cycle.
+func (s *MockDatadogServer) ExpectValidTrace(t testing.TB, traceID string) {
+	t.Helper()
+
+	if err := s.CheckValidTrace(traceID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckValidTrace returns an error unless the trace with the given trace ID has exactly one root and its parent
+// references contain no cycles. The error lists the IDs of the offending spans.
+func (s *MockDatadogServer) CheckValidTrace(traceID string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.traceSpans(traceID)
+	if len(spans) == 0 {
+		return fmt.Errorf("trace %s not found", traceID)
+	}
+	if problems := traceProblems(spans); len(problems) > 0 {
+		return fmt.Errorf("trace %s is invalid, %s", traceID, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// traceProblems describes why the spans of a single trace do not form a tree with exactly one root.
+func traceProblems(spans []Span) []string {
+	byID := make(map[uint64]Span, len(spans))
+	for _, span := range spans {
+		byID[span.SpanID] = span
+	}
+
+	roots := []uint64{}
+	cyclic := []uint64{}
+	for _, span := range spans {
+		if _, ok := byID[span.ParentID]; span.ParentID == 0 || !ok {
+			roots = append(roots, span.SpanID)
+			continue
+		}
+
+		visited := map[uint64]struct{}{span.SpanID: {}}
+		for current, ok := byID[span.ParentID]; ok; current, ok = byID[current.ParentID] {
+			if _, seen := visited[current.SpanID]; seen {
+				cyclic = append(cyclic, span.SpanID)
+				break
+			}
+			visited[current.SpanID] = struct{}{}
+		}
+	}
+
+	problems := []string{}
+	if len(roots) != 1 {
+		problems = append(problems, fmt.Sprintf("expected exactly one root, found %d: span ids %v", len(roots), roots))
+	}
+	if len(cyclic) > 0 {
+		problems = append(problems, fmt.Sprintf("parents of span ids %v form a cycle", cyclic))
+	}
+	return problems
+}
+
+// ExpectTraceCount ensures that the received spans belong to exactly n distinct trace IDs. A trace that the tracer
+// flushed in several chunks is counted once, and traces are distinguished by their full 128-bit IDs.
+func (s *MockDatadogServer) ExpectTraceCount(t testing.TB, n int) {
+	t.Helper()
+
+	if err := s.CheckTraceCount(n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckTraceCount returns an error unless the received spans belong to exactly n distinct trace IDs. The error
+// lists each full trace ID along with the names of its root spans.
+func (s *MockDatadogServer) CheckTraceCount(n int) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if len(s.spansByTrace) == n {
+		return nil
+	}
+
+	traceIDs := make([]string, 0, len(s.spansByTrace))
+	for traceID := range s.spansByTrace {
+		traceIDs = append(traceIDs, traceID)
+	}
+	slices.Sort(traceIDs)
+
+	traces := make([]string, 0, len(traceIDs))
+	for _, traceID := range traceIDs {
+		roots := []string{}
+		for _, root := range BuildTraceTree(s.spansByTrace[traceID]) {
+			roots = append(roots, root.Span.Name)
+		}
+		traces = append(traces, fmt.Sprintf("%s %v", traceID, roots))
+	}
+	return fmt.Errorf("expected %d traces, found %d: %s", n, len(traceIDs), strings.Join(traces, ", "))
+}
+
+// ExpectTraceSpanCount ensures that the trace with the given 128-bit trace ID, as returned by FullTraceID, contains
+// exactly n spans.
+func (s *MockDatadogServer) ExpectTraceSpanCount(t testing.TB, traceID string, n int) {
+	t.Helper()
+
+	if err := s.CheckTraceSpanCount(traceID, n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckTraceSpanCount returns an error unless the trace with the given trace ID contains exactly n spans. The
+// error lists the names of the spans that were received for the trace.
+func (s *MockDatadogServer) CheckTraceSpanCount(traceID string, n int) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.traceSpans(traceID)
+	if len(spans) == n {
+		return nil
+	}
+
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	return fmt.Errorf("expected %d spans in trace %s, found %d: %v", n, traceID, len(spans), names)
+}
+
+// ExpectSameTrace ensures that spans with each of the given names were received as part of a single trace,
+// regardless of the service that reported them.
+func (s *MockDatadogServer) ExpectSameTrace(t testing.TB, names ...string) {
+	t.Helper()
+
+	if err := s.CheckSameTrace(names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSameTrace returns an error unless some trace contains a span with each of the given names. When several
+// spans share a name, any one of them may be part of the common trace. Traces are compared by their full 128-bit IDs.
+func (s *MockDatadogServer) CheckSameTrace(names ...string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var common map[string]struct{}
+	for i, name := range names {
+		spans := s.spans.ByName(name)
+		if len(spans) == 0 {
+			return fmt.Errorf("span named %q not found, received spans: %v", name, s.spanNames())
+		}
+
+		traces := make(map[string]struct{}, len(spans))
+		for _, span := range spans {
+			traceID := s.spanTraceID(span)
+			if _, ok := common[traceID]; ok || i == 0 {
+				traces[traceID] = struct{}{}
+			}
+		}
+		if len(traces) == 0 {
+			return fmt.Errorf("span named %q does not share a trace with %q", name, names[:i])
+		}
+		common = traces
+	}
+	return nil
+}
+
+// ExpectSpanParentAcrossTrace ensures that a span with the child name was received whose direct parent, matched
+// by span ID regardless of service, is a span with the parent name in the same trace.
+func (s *MockDatadogServer) ExpectSpanParentAcrossTrace(t testing.TB, child, parent string) {
+	t.Helper()
+
+	if err := s.CheckSpanParentAcrossTrace(child, parent); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanParentAcrossTrace returns an error unless a span with the child name was received whose direct parent
+// is a span with the parent name in the same trace. Traces are compared by their full 128-bit IDs.
+func (s *MockDatadogServer) CheckSpanParentAcrossTrace(child, parent string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(child, func(span Span) error {
+		if span.ParentID == 0 {
+			return fmt.Errorf("span named %q in service %q has no parent, expected %q", child, span.Service, parent)
+		}
+		found, ok := s.spans.ByID(span.ParentID)
+		if !ok {
+			return fmt.Errorf("parent span for %q in service %q not found, parent id %d was never received", child, span.Service, span.ParentID)
+		}
+		if found.Name != parent {
+			return fmt.Errorf("span named %q in service %q has parent %q in service %q, expected %q", child, span.Service, found.Name, found.Service, parent)
+		}
+		if traceID, parentTraceID := s.spanTraceID(span), s.spanTraceID(found); traceID != parentTraceID {
+			return fmt.Errorf("span named %q in service %q is in trace %s but its parent %q in service %q is in trace %s", child, span.Service, traceID, parent, found.Service, parentTraceID)
+		}
+		return nil
+	})
+}
+
+// ExpectSpanLink ensures that a span with the given name was received with a link to the span with the given
+// trace and span IDs, such as a consumer linking to the trace of the producer whose message it handled. The trace
+// ID is compared against the lower 64 bits of the linked trace ID.
+func (s *MockDatadogServer) ExpectSpanLink(t testing.TB, name string, linkedTraceID, linkedSpanID uint64) {
+	t.Helper()
+
+	if err := s.CheckSpanLink(name, linkedTraceID, linkedSpanID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanLink returns an error unless a span with the given name was received with a link to the span with the
+// given trace and span IDs.
+func (s *MockDatadogServer) CheckSpanLink(name string, linkedTraceID, linkedSpanID uint64) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		links := make([]string, 0, len(span.Links))
+		for _, link := range span.Links {
+			if link.TraceID == linkedTraceID && link.SpanID == linkedSpanID {
+				return nil
+			}
+			links = append(links, fmt.Sprintf("%d/%d", link.TraceID, link.SpanID))
+		}
+		return fmt.Errorf("span named %q has no link to span %d in trace %d, found links (trace/span): %v", name, linkedSpanID, linkedTraceID, links)
+	})
+}
+
+// ExpectErrorSpan ensures that a span with the given name was received and marked as errored.
+func (s *MockDatadogServer) ExpectErrorSpan(t testing.TB, name string) {
+	t.Helper()
+
+	if err := s.CheckErrorSpan(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckErrorSpan returns an error unless a span with the given name was received and marked as errored.
+func (s *MockDatadogServer) CheckErrorSpan(name string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.matchSpan(name, func(span Span) error {
+		if span.Error == 0 {
+			return fmt.Errorf("span named %q was not marked as errored (%s)", name, errorDetails(span))
+		}
+		return nil
+	})
+}
+
+// ExpectNoErrorSpan ensures that a span with the given name was received and that none of the spans with that
+// name were marked as errored.
+func (s *MockDatadogServer) ExpectNoErrorSpan(t testing.TB, name string) {
+	t.Helper()
+
+	if err := s.CheckNoErrorSpan(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckNoErrorSpan returns an error unless a span with the given name was received and none of the spans with
+// that name were marked as errored.
+func (s *MockDatadogServer) CheckNoErrorSpan(name string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+	}
+
+	for _, span := range spans {
+		if span.Error != 0 {
+			return fmt.Errorf("span named %q was unexpectedly marked as errored (%s)", name, errorDetails(span))
+		}
+	}
+	return nil
+}
+
+// ExpectNoErrors ensures that none of the received spans were marked as errored, a quick check at the end of a
+// happy path test that nothing instrumented failed unexpectedly.
+func (s *MockDatadogServer) ExpectNoErrors(t testing.TB) {
+	t.Helper()
+
+	if err := s.CheckNoErrors(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckNoErrors returns an error listing every errored span along with its error tags if any received span was
+// marked as errored.
+func (s *MockDatadogServer) CheckNoErrors() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	errored := []string{}
+	for _, span := range s.spans.All() {
+		if span.Error != 0 {
+			errored = append(errored, fmt.Sprintf("%q (%s)", span.Name, errorDetails(span)))
+		}
+	}
+	if len(errored) > 0 {
+		return fmt.Errorf("%d spans were unexpectedly marked as errored: %s", len(errored), strings.Join(errored, ", "))
+	}
+	return nil
+}
+
+// ExpectPositiveDurations ensures that every received span has a positive duration, catching instrumentation that
+// finishes spans before they start.
+func (s *MockDatadogServer) ExpectPositiveDurations(t testing.TB) {
+	t.Helper()
+
+	if err := s.CheckPositiveDurations(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckPositiveDurations returns an error listing every span whose duration is zero or negative.
+func (s *MockDatadogServer) CheckPositiveDurations() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	invalid := []string{}
+	for _, span := range s.spans.All() {
+		if span.Duration <= 0 {
+			invalid = append(invalid, fmt.Sprintf("%q (duration=%v)", span.Name, time.Duration(span.Duration)))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d spans have non-positive durations: %s", len(invalid), strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// ExpectErrorCount ensures that exactly n spans with the given name were marked as errored, such as the failed
+// attempts of an operation that is retried.
+func (s *MockDatadogServer) ExpectErrorCount(t testing.TB, name string, n int) {
+	t.Helper()
+
+	if err := s.CheckErrorCount(name, n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckErrorCount returns an error including the error messages of the errored spans unless exactly n spans with
+// the given name were marked as errored.
+func (s *MockDatadogServer) CheckErrorCount(name string, n int) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	messages := []string{}
+	for _, span := range spans {
+		if span.Error != 0 {
+			messages = append(messages, span.Meta[ext.ErrorMsg])
+		}
+	}
+	if len(messages) != n {
+		return fmt.Errorf("expected %d errored spans named %q, got %d of %d received, error messages: %q", n, name, len(messages), len(spans), messages)
+	}
+	return nil
+}
+
+// ExpectHeader ensures that the most recent request to a trace endpoint was sent with the header set to value.
+func (s *MockDatadogServer) ExpectHeader(t testing.TB, key, value string) {
+	t.Helper()
+
+	if err := s.CheckHeader(key, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckHeader returns an error unless the most recent request to a trace endpoint was sent with the header set
+// to value.
+func (s *MockDatadogServer) CheckHeader(key, value string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.lastHeaders == nil {
+		return errors.New("no requests to a trace endpoint received")
+	}
+	if _, ok := s.lastHeaders[http.CanonicalHeaderKey(key)]; !ok {
+		return fmt.Errorf("header %q not found on the last trace request", key)
+	}
+	if got := s.lastHeaders.Get(key); got != value {
+		return fmt.Errorf("header %q has value %q on the last trace request, expected %q", key, got, value)
+	}
+	return nil
+}
+
+// ExpectSpanOrder ensures that the most recently received spans with the given names started in the given order.
+func (s *MockDatadogServer) ExpectSpanOrder(t testing.TB, names ...string) {
+	t.Helper()
+
+	if err := s.CheckSpanOrder(names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSpanOrder returns an error unless the Start times of the most recently received spans with the given names
+// are non-decreasing in the given order. The error lists every start time relative to the earliest span.
+func (s *MockDatadogServer) CheckSpanOrder(names ...string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	starts := make([]int64, len(names))
+	for i, name := range names {
+		spans := s.spans.ByName(name)
+		if len(spans) == 0 {
+			return fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+		}
+		starts[i] = spans[len(spans)-1].Start
+	}
+
+	for i := 1; i < len(starts); i++ {
+		if starts[i] >= starts[i-1] {
+			continue
+		}
+		earliest := slices.Min(starts)
+		relative := make([]string, len(names))
+		for j, name := range names {
+			relative[j] = fmt.Sprintf("%s=+%v", name, time.Duration(starts[j]-earliest))
+		}
+		return fmt.Errorf("span named %q started before %q, start times: %s", names[i], names[i-1], strings.Join(relative, ", "))
+	}
+	return nil
+}
+
+// ExpectNoDecodeErrors ensures that every request sent to a trace endpoint or /v0.6/stats was decoded successfully.
+func (s *MockDatadogServer) ExpectNoDecodeErrors(t testing.TB) {
+	t.Helper()
+
+	if err := s.CheckNoDecodeErrors(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckNoDecodeErrors returns an error if any request sent to a trace endpoint or /v0.6/stats failed to decode.
+func (s *MockDatadogServer) CheckNoDecodeErrors() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if len(s.decodeErrors) > 0 {
+		return fmt.Errorf("%d requests failed to decode: %v", len(s.decodeErrors), s.decodeErrors)
+	}
+	return nil
+}
+
+// errorDetails formats the conventional error tags of a span for failure messages.
+func errorDetails(span Span) string {
+	return fmt.Sprintf("%s=%q, %s=%q", ext.ErrorMsg, span.Meta[ext.ErrorMsg], ext.ErrorType, span.Meta[ext.ErrorType])
+}
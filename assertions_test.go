@@ -0,0 +1,659 @@
+package doghouse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSpan(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "parent", SpanID: 1})
+	s.store(Span{Name: "child", SpanID: 2, ParentID: 1})
+
+	if err := s.CheckSpan("child", "parent"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.CheckSpan("child", "other"); err == nil {
+		t.Fatal("expected mismatched parent error")
+	}
+	if err := s.CheckSpan("missing"); err == nil {
+		t.Fatal("expected missing span error")
+	}
+	if !s.HasSpanWithParents("child", "parent") || !s.HasSpanWithParents("child") {
+		t.Fatal("expected span with parents")
+	}
+	if s.HasSpanWithParents("child", "other") || s.HasSpanWithParents("missing") {
+		t.Fatal("unexpected span with parents")
+	}
+
+	span, err := s.FindSpan("child")
+	if err != nil || span.SpanID != 2 {
+		t.Fatalf("unexpected span %+v: %v", span, err)
+	}
+	if _, err := s.FindSpan("missing"); err == nil {
+		t.Fatal("expected missing span error")
+	}
+}
+
+func TestExpectNoSpansForService(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "request", Service: "web", SpanID: 1})
+	s.store(Span{Name: "query", Service: "db", SpanID: 2})
+	s.store(Span{Name: "ping", Service: "db", SpanID: 3})
+
+	s.ExpectNoSpansForService(t, "healthcheck")
+	err := s.CheckNoSpansForService("db")
+	if err == nil || !strings.Contains(err.Error(), "[query ping]") {
+		t.Fatalf("expected offending spans to be listed, got: %v", err)
+	}
+}
+
+func TestExpectSpanDescendsFrom(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "request", SpanID: 1})
+	s.store(Span{Name: "middleware", SpanID: 2, ParentID: 1})
+	s.store(Span{Name: "query", SpanID: 3, ParentID: 2})
+	s.store(Span{Name: "loop", SpanID: 4, ParentID: 5})
+	s.store(Span{Name: "back", SpanID: 5, ParentID: 4})
+
+	s.ExpectSpanDescendsFrom(t, "query", "request")
+	s.ExpectSpanDescendsFrom(t, "query", "middleware")
+	err := s.CheckSpanDescendsFrom("query", "handler")
+	if err == nil || !strings.Contains(err.Error(), "query -> middleware -> request") {
+		t.Fatalf("expected the chain of parents to be reported, got: %v", err)
+	}
+	if err := s.CheckSpanDescendsFrom("query", "query"); err == nil {
+		t.Fatal("expected a span not to descend from itself")
+	}
+	if err := s.CheckSpanDescendsFrom("loop", "request"); err == nil || !strings.Contains(err.Error(), "loop -> back") {
+		t.Fatalf("expected a parent cycle to stop the walk, got: %v", err)
+	}
+}
+
+func TestAwaitSpan(t *testing.T) {
+	s := newMockDatadogServer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := s.AwaitSpan(ctx, "missing"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+	if err := s.AwaitNoSpan(ctx, "missing"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	postBatch(t, s, Batch{{{Name: "present", SpanID: 1}}})
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := s.AwaitSpan(ctx, "present"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.AwaitNoSpan(ctx, "present"); err == nil {
+		t.Fatal("expected unexpected span error")
+	}
+	if err := s.AwaitSpanCount(ctx, "present", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func BenchmarkExpectSpan(b *testing.B) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "parent", SpanID: 1})
+	s.store(Span{Name: "child", SpanID: 2, ParentID: 1})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ExpectSpan(b, "child", "parent")
+	}
+}
+
+func TestParentCycle(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "a", SpanID: 1, TraceID: 1, ParentID: 2},
+		{Name: "b", SpanID: 2, TraceID: 1, ParentID: 1},
+	}})
+
+	s.ExpectSpan(t, "a", "b")
+	if err := s.CheckSpan("a", "b", "a", "b"); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected cycle to be reported, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.AwaitSpan(ctx, "b", "a", "b"); err == nil || !strings.Contains(err.Error(), "cycle") || ctx.Err() != nil {
+		t.Fatalf("expected cycle to be reported immediately, got %v", err)
+	}
+}
+
+func TestDumpParentCycle(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "a", SpanID: 1, TraceID: 1, ParentID: 2, Start: 1},
+		{Name: "b", SpanID: 2, TraceID: 1, ParentID: 1, Start: 2},
+	}})
+
+	expected := `trace 1
+  a (service="", resource="", duration=0s)
+    b (service="", resource="", duration=0s)
+`
+	if actual := s.Dump(); actual != expected {
+		t.Fatalf("unexpected dump:\n%s", actual)
+	}
+	if err := s.CheckSpan("a", "missing"); err == nil {
+		t.Fatal("expected mismatched parents to fail")
+	}
+}
+
+func TestAwaitNoSpanFailsFast(t *testing.T) {
+	s := newMockDatadogServer()
+	if s.HasSpan("fast") {
+		t.Fatal("unexpected span")
+	}
+
+	req := batchRequest(t, Batch{{{Name: "fast", SpanID: 1}}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.AwaitNoSpan(ctx, "fast"); err == nil {
+		t.Fatal("expected unexpected span error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected to fail as soon as the span arrived, took %v", elapsed)
+	}
+	if !s.HasSpan("fast") {
+		t.Fatal("expected span")
+	}
+}
+
+func TestAwaitSpans(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{{Name: "first", SpanID: 1}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := s.AwaitSpans(ctx, "first", "second", "third")
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "[second third]") {
+		t.Fatalf("expected missing spans to be listed, got: %v", err)
+	}
+
+	req := batchRequest(t, Batch{{{Name: "second", SpanID: 2}, {Name: "third", SpanID: 3}}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	s.WaitForSpans(t, time.Second, "first", "second", "third")
+}
+
+func TestWaitForSpanWithMeta(t *testing.T) {
+	s := newMockDatadogServer(WithDefaultWaitTimeout(time.Second))
+	postBatch(t, s, Batch{{
+		{Name: "request", SpanID: 1, Meta: map[string]string{"variant": "a"}},
+		{Name: "request", SpanID: 2, Meta: map[string]string{"variant": "b", "phase": "start"}},
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := s.AwaitSpanWithMeta(ctx, "request", map[string]string{"variant": "b", "phase": "done"})
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "map[phase:start variant:b]") {
+		t.Fatalf("expected closest span meta to be reported, got: %v", err)
+	}
+
+	req := batchRequest(t, Batch{{{Name: "request", SpanID: 3, Meta: map[string]string{"variant": "b", "phase": "done"}}}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	s.WaitForSpanWithMeta(t, "request", map[string]string{"variant": "b", "phase": "done"})
+}
+
+func TestWaitForTrace(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "child", SpanID: 2, TraceID: 1, ParentID: 1, Start: 2},
+		{Name: "grandchild", SpanID: 3, TraceID: 1, ParentID: 2, Start: 3},
+	}})
+	postBatch(t, s, Batch{{{Name: "other", SpanID: 4, TraceID: 2}}})
+
+	req := batchRequest(t, Batch{{{Name: "root", SpanID: 1, TraceID: 1, Start: 1}}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	spans := s.WaitForTrace(t, "root", time.Second)
+	if len(spans) != 3 || spans[0].Name != "root" || spans[1].Name != "child" || spans[2].Name != "grandchild" {
+		t.Fatalf("unexpected trace: %+v", spans)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.AwaitTrace(ctx, "child"); !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "root span") {
+		t.Fatalf("expected a span with a parent not to count as a root, got: %v", err)
+	}
+}
+
+func TestWaitAndGetSpan(t *testing.T) {
+	s := newMockDatadogServer(WithDefaultWaitTimeout(time.Second))
+
+	req := batchRequest(t, Batch{{
+		{Name: "parent", SpanID: 1, TraceID: 1},
+		{Name: "child", SpanID: 2, TraceID: 1, ParentID: 1, Meta: map[string]string{"env": "test"}},
+	}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	span := s.WaitAndGetSpan(t, "child", "parent")
+	if span.SpanID != 2 || span.Meta["env"] != "test" {
+		t.Fatalf("unexpected span: %+v", span)
+	}
+	span.Meta["env"] = "changed"
+	s.ExpectSpanMeta(t, "child", map[string]string{"env": "test"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.AwaitAndGetSpan(ctx, "child", "other"); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected mismatched parent to fail immediately, got %v", err)
+	}
+}
+
+func TestWaitForQuiescence(t *testing.T) {
+	s := newMockDatadogServer()
+
+	done := make(chan struct{})
+	requests := make([]*http.Request, 5)
+	for i := range requests {
+		requests[i] = batchRequest(t, Batch{{{Name: "busy", SpanID: uint64(i + 1)}}})
+	}
+	go func() {
+		defer close(done)
+		for _, req := range requests {
+			s.ServeHTTP(httptest.NewRecorder(), req)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	s.WaitForQuiescence(t, 50*time.Millisecond, 5*time.Second)
+	<-done
+	s.ExpectSpanCount(t, "busy", 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.AwaitQuiescence(ctx, time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+}
+
+func TestExpectSpanDuration(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "timed", SpanID: 1, Duration: int64(50 * time.Millisecond)})
+
+	s.ExpectSpanDuration(t, "timed", 10*time.Millisecond, 100*time.Millisecond)
+	s.ExpectSpanDuration(t, "timed", 50*time.Millisecond, 50*time.Millisecond)
+	if err := s.CheckSpanDuration("timed", 0, 10*time.Millisecond); err == nil {
+		t.Fatal("expected duration above the maximum to fail")
+	}
+	if err := s.CheckSpanDuration("timed", time.Second, 2*time.Second); err == nil {
+		t.Fatal("expected duration below the minimum to fail")
+	}
+}
+
+func TestExpectSpanTypeAndKind(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "handler", Type: "web", SpanID: 1, Meta: map[string]string{"span.kind": "server"}})
+	s.store(Span{Name: "custom", Type: "custom", SpanID: 2})
+
+	s.ExpectSpanType(t, "handler", "web")
+	s.ExpectSpanKind(t, "handler", "server")
+	if err := s.CheckSpanType("custom", "sql"); err == nil {
+		t.Fatal("expected mismatched type to fail")
+	}
+	if err := s.CheckSpanKind("handler", "client"); err == nil {
+		t.Fatal("expected mismatched kind to fail")
+	}
+	if err := s.CheckSpanKind("custom", "internal"); err == nil {
+		t.Fatal("expected missing kind to fail")
+	}
+}
+
+func TestExpectSpanEnvAndVersion(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "tagged", SpanID: 1, Meta: map[string]string{"env": "prod", "version": "1.2.3"}})
+	s.store(Span{Name: "internal", SpanID: 2, Meta: map[string]string{"_dd.env": "staging", "_dd.version": "abc"}})
+	s.store(Span{Name: "untagged", SpanID: 3})
+
+	s.ExpectSpanEnv(t, "tagged", "prod")
+	s.ExpectSpanVersion(t, "tagged", "1.2.3")
+	s.ExpectSpanEnv(t, "internal", "staging")
+	s.ExpectSpanVersion(t, "internal", "abc")
+	if err := s.CheckSpanEnv("tagged", "staging"); err == nil || !strings.Contains(err.Error(), `has env "prod"`) {
+		t.Fatalf("expected mismatched env to fail, got %v", err)
+	}
+	if err := s.CheckSpanVersion("untagged", "1.2.3"); err == nil || !strings.Contains(err.Error(), "no version tag") {
+		t.Fatalf("expected missing version to fail, got %v", err)
+	}
+}
+
+func TestExpectHTTPSpan(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "http.request", Type: "web", SpanID: 1, Meta: map[string]string{
+		"http.method":      "GET",
+		"http.route":       "/users/{id}",
+		"http.url":         "http://localhost/users/1",
+		"http.status_code": "200",
+	}})
+	s.store(Span{Name: "http.incomplete", Type: "web", SpanID: 2, Meta: map[string]string{
+		"http.method": "POST",
+	}})
+
+	s.ExpectHTTPSpan(t, "http.request", "GET", "/users/{id}", 200)
+	if err := s.CheckHTTPSpan("http.request", "POST", "/users/{id}", 404); err == nil {
+		t.Fatal("expected mismatched tags to fail")
+	}
+
+	err := s.CheckHTTPSpan("http.incomplete", "POST", "/users", 201)
+	if err == nil {
+		t.Fatal("expected missing tags to fail")
+	}
+	for _, key := range []string{"http.route", "http.status_code", "http.url"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Fatalf("expected error to report %s, got %v", key, err)
+		}
+	}
+}
+
+func TestExpectDBSpan(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "postgres.query", Type: "sql", SpanID: 1, Meta: map[string]string{
+		"db.type":     "postgres",
+		"db.instance": "users",
+		"sql.query":   "SELECT * FROM users WHERE id = ?",
+	}})
+	s.store(Span{Name: "mysql.query", Type: "sql", SpanID: 2, Meta: map[string]string{
+		"db.type":      "mysql",
+		"db.instance":  "orders",
+		"db.statement": "SELECT * FROM orders",
+	}})
+	s.store(Span{Name: "redis.command", Type: "redis", SpanID: 3, Meta: map[string]string{
+		"db.type": "redis",
+	}})
+
+	s.ExpectDBSpan(t, "postgres.query", "postgres", "SELECT * FROM users WHERE id = ?")
+	s.ExpectDBSpan(t, "mysql.query", "mysql", "SELECT * FROM orders")
+	if err := s.CheckDBSpan("postgres.query", "postgres", "SELECT * FROM users WHERE id = 1"); err == nil {
+		t.Fatal("expected mismatched statement to fail")
+	}
+
+	err := s.CheckDBSpan("redis.command", "redis", "GET key")
+	if err == nil {
+		t.Fatal("expected incomplete database span to fail")
+	}
+	for _, part := range []string{"db.instance", "type", "statement"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Fatalf("expected error to report %s, got %v", part, err)
+		}
+	}
+}
+
+func TestExpectResourceNormalized(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "postgres.query", SpanID: 1, Resource: `SELECT * FROM "users2" WHERE id = ? AND name = ?`})
+	s.store(Span{Name: "http.request", SpanID: 2, Resource: "GET /users/?"})
+	s.store(Span{Name: "http.request", SpanID: 3, Resource: "GET /users/42"})
+	s.store(Span{Name: "mysql.query", SpanID: 4, Resource: "SELECT * FROM users WHERE email = 'jane@example.com'"})
+
+	s.ExpectResourceNormalized(t, "postgres.query")
+	err := s.CheckResourceNormalized("http.request")
+	if err == nil || !strings.Contains(err.Error(), `"GET /users/42" contains "42"`) {
+		t.Fatalf("expected the offending resource to be reported, got: %v", err)
+	}
+	if err := s.CheckResourceNormalized("mysql.query"); err == nil {
+		t.Fatal("expected a quoted string literal to fail")
+	}
+	if err := s.CheckResourceNormalized("missing"); err == nil {
+		t.Fatal("expected missing span to fail")
+	}
+
+	custom := newMockDatadogServer(WithNormalizationPattern(regexp.MustCompile(`@`)))
+	custom.store(Span{Name: "cache.get", SpanID: 1, Resource: "GET user:42"})
+	custom.store(Span{Name: "cache.set", SpanID: 2, Resource: "SET jane@example.com"})
+	custom.ExpectResourceNormalized(t, "cache.get")
+	if err := custom.CheckResourceNormalized("cache.set"); err == nil {
+		t.Fatal("expected the custom pattern to be used")
+	}
+}
+
+func TestExpectRootAndLeafSpan(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "root", SpanID: 1})
+	s.store(Span{Name: "middle", SpanID: 2, ParentID: 1})
+	s.store(Span{Name: "leaf", SpanID: 3, ParentID: 2})
+	s.store(Span{Name: "orphan", SpanID: 4, ParentID: 5})
+
+	s.ExpectRootSpan(t, "root")
+	s.ExpectLeafSpan(t, "leaf")
+	s.ExpectLeafSpan(t, "orphan")
+
+	for _, name := range []string{"middle", "leaf", "orphan"} {
+		if err := s.CheckRootSpan(name); err == nil {
+			t.Fatalf("expected %q not to be a root", name)
+		}
+	}
+	for _, name := range []string{"root", "middle"} {
+		if err := s.CheckLeafSpan(name); err == nil {
+			t.Fatalf("expected %q not to be a leaf", name)
+		}
+	}
+}
+
+func TestExpectNoOrphans(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "root", SpanID: 1})
+	s.store(Span{Name: "child", SpanID: 2, ParentID: 1})
+	s.ExpectNoOrphans(t)
+
+	s.store(Span{Name: "orphan", SpanID: 3, ParentID: 4})
+	err := s.CheckNoOrphans()
+	if err == nil || !strings.Contains(err.Error(), `"orphan"`) {
+		t.Fatalf("expected orphan error, got: %v", err)
+	}
+	if orphans := s.GetOrphans(); len(orphans) != 1 || orphans[0].Name != "orphan" {
+		t.Fatalf("unexpected orphans: %+v", orphans)
+	}
+}
+
+func TestExpectTraceCount(t *testing.T) {
+	s := newMockDatadogServer()
+	s.ExpectTraceCount(t, 0)
+
+	postBatch(t, s, Batch{
+		{{Name: "request", SpanID: 1, TraceID: 1}, {Name: "query", SpanID: 2, TraceID: 1, ParentID: 1}},
+		{{Name: "cache", SpanID: 3, TraceID: 1, ParentID: 1}},
+		{{Name: "detached", SpanID: 4, TraceID: 2}},
+	})
+
+	s.ExpectTraceCount(t, 2)
+	s.ExpectTraceSpanCount(t, hexTraceID(1), 3)
+	s.ExpectTraceSpanCount(t, hexTraceID(3), 0)
+	if err := s.CheckTraceSpanCount(hexTraceID(2), 2); err == nil || !strings.Contains(err.Error(), "found 1: [detached]") {
+		t.Fatalf("expected span count mismatch to list spans, got %v", err)
+	}
+	err := s.CheckTraceCount(1)
+	if err == nil || !strings.Contains(err.Error(), "found 2: 00000000000000000000000000000001 [request], 00000000000000000000000000000002 [detached]") {
+		t.Fatalf("expected trace count mismatch to list traces, got %v", err)
+	}
+}
+
+func TestExpectSameTrace(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "frontend.request", Service: "frontend", SpanID: 1, TraceID: 10})
+	s.store(Span{Name: "backend.request", Service: "backend", SpanID: 2, TraceID: 10, ParentID: 1})
+	s.store(Span{Name: "backend.request", Service: "backend", SpanID: 3, TraceID: 20})
+	s.store(Span{Name: "worker.job", Service: "worker", SpanID: 4, TraceID: 30, ParentID: 99})
+	s.store(Span{Name: "worker.parent", Service: "worker", SpanID: 99, TraceID: 31})
+
+	s.ExpectSameTrace(t, "frontend.request", "backend.request")
+	s.ExpectSpanParentAcrossTrace(t, "backend.request", "frontend.request")
+
+	if err := s.CheckSameTrace("frontend.request", "worker.job"); err == nil {
+		t.Fatal("expected spans in different traces to fail")
+	}
+	if err := s.CheckSameTrace("frontend.request", "missing"); err == nil {
+		t.Fatal("expected a missing span to fail")
+	}
+	if err := s.CheckSpanParentAcrossTrace("frontend.request", "backend.request"); err == nil {
+		t.Fatal("expected a root span to fail")
+	}
+	if err := s.CheckSpanParentAcrossTrace("worker.job", "worker.parent"); err == nil {
+		t.Fatal("expected a parent in a different trace to fail")
+	}
+}
+
+func TestTraceAssertionsUseFullTraceID(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{
+		{
+			{Name: "a.root", SpanID: 1, TraceID: 7, Meta: map[string]string{traceIDHighTag: "6553f2a400000000"}},
+			{Name: "a.child", SpanID: 2, TraceID: 7, ParentID: 1},
+		},
+		{
+			{Name: "b.root", SpanID: 3, TraceID: 7, Meta: map[string]string{traceIDHighTag: "6553f2a500000000"}},
+			{Name: "b.child", SpanID: 4, TraceID: 7, ParentID: 3},
+		},
+		{{Name: "c.child", SpanID: 5, TraceID: 7, ParentID: 1, Meta: map[string]string{traceIDHighTag: "6553f2a600000000"}}},
+	})
+
+	s.ExpectTraceCount(t, 3)
+	s.ExpectSameTrace(t, "a.root", "a.child")
+	s.ExpectSpanParentAcrossTrace(t, "b.child", "b.root")
+	s.ExpectValidTrace(t, "6553f2a4000000000000000000000007")
+	s.ExpectValidTrace(t, "6553f2a5000000000000000000000007")
+	if err := s.CheckSameTrace("a.root", "b.root"); err == nil {
+		t.Fatal("expected traces sharing the lower 64 bits to be distinct")
+	}
+	if err := s.CheckSpanParentAcrossTrace("c.child", "a.root"); err == nil || !strings.Contains(err.Error(), "6553f2a600000000") {
+		t.Fatalf("expected a parent in a different 128-bit trace to fail, got %v", err)
+	}
+}
+
+func TestExpectValidTrace(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "root", SpanID: 1, TraceID: 1})
+	s.store(Span{Name: "child", SpanID: 2, TraceID: 1, ParentID: 1})
+	s.ExpectValidTrace(t, hexTraceID(1))
+
+	s.store(Span{Name: "root", SpanID: 3, TraceID: 2})
+	s.store(Span{Name: "root", SpanID: 4, TraceID: 2, ParentID: 99})
+	if err := s.CheckValidTrace(hexTraceID(2)); err == nil || !strings.Contains(err.Error(), "[3 4]") {
+		t.Fatalf("expected multiple roots to be reported, got %v", err)
+	}
+
+	s.store(Span{Name: "root", SpanID: 5, TraceID: 3})
+	s.store(Span{Name: "loop", SpanID: 6, TraceID: 3, ParentID: 7})
+	s.store(Span{Name: "loop", SpanID: 7, TraceID: 3, ParentID: 6})
+	if err := s.CheckValidTrace(hexTraceID(3)); err == nil || !strings.Contains(err.Error(), "[6 7]") {
+		t.Fatalf("expected cycle to be reported, got %v", err)
+	}
+
+	if err := s.CheckValidTrace(hexTraceID(4)); err == nil {
+		t.Fatal("expected missing trace to fail")
+	}
+}
+
+func TestExpectNoErrors(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "request", SpanID: 1})
+	s.ExpectNoErrors(t)
+
+	s.store(Span{Name: "query", SpanID: 2, Error: 1, Meta: map[string]string{"error.message": "timeout", "error.type": "*net.OpError"}})
+	err := s.CheckNoErrors()
+	if err == nil || !strings.Contains(err.Error(), `"query" (error.message="timeout", error.type="*net.OpError")`) {
+		t.Fatalf("expected errored span to be reported with its error tags, got: %v", err)
+	}
+}
+
+func TestExpectPositiveDurations(t *testing.T) {
+	var buf bytes.Buffer
+	s := newMockDatadogServer(WithDurationWarnings(), WithLogger(log.New(&buf, "", 0)))
+	postBatch(t, s, Batch{{{Name: "valid", SpanID: 1, Duration: 10}}})
+	s.ExpectPositiveDurations(t)
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected warning: %q", buf.String())
+	}
+
+	postBatch(t, s, Batch{{{Name: "instant", SpanID: 2}, {Name: "backwards", SpanID: 3, Duration: -5}}})
+	err := s.CheckPositiveDurations()
+	if err == nil || !strings.Contains(err.Error(), `"instant" (duration=0s), "backwards" (duration=-5ns)`) {
+		t.Fatalf("expected invalid spans to be listed, got: %v", err)
+	}
+	if !strings.Contains(buf.String(), `received span "backwards" with non-positive duration -5ns`) {
+		t.Fatalf("expected a warning to be logged, got: %q", buf.String())
+	}
+
+	quiet := newMockDatadogServer(WithLogger(log.New(&buf, "", 0)))
+	buf.Reset()
+	postBatch(t, quiet, Batch{{{Name: "instant", SpanID: 1}}})
+	if buf.Len() != 0 {
+		t.Fatalf("expected no warning without the option, got: %q", buf.String())
+	}
+}
+
+func TestExpectErrorCount(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "attempt", SpanID: 1, Error: 1, Meta: map[string]string{"error.message": "unavailable"}})
+	s.store(Span{Name: "attempt", SpanID: 2, Error: 1, Meta: map[string]string{"error.message": "deadline exceeded"}})
+	s.store(Span{Name: "attempt", SpanID: 3})
+	s.store(Span{Name: "request", SpanID: 4})
+
+	if counts := s.ErrorCounts(); len(counts) != 1 || counts["attempt"] != 2 {
+		t.Fatalf("unexpected error counts: %v", counts)
+	}
+	s.ExpectErrorCount(t, "attempt", 2)
+	s.ExpectErrorCount(t, "request", 0)
+
+	err := s.CheckErrorCount("attempt", 1)
+	if err == nil || !strings.Contains(err.Error(), `got 2 of 3 received, error messages: ["unavailable" "deadline exceeded"]`) {
+		t.Fatalf("expected error messages to be reported, got: %v", err)
+	}
+}
+
+func TestExpectSpanOrder(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "connect", Start: 100, SpanID: 1, TraceID: 1},
+		{Name: "query", Start: 150, SpanID: 2, TraceID: 1},
+		{Name: "close", Start: 150, SpanID: 3, TraceID: 1},
+	}})
+
+	s.ExpectSpanOrder(t, "connect", "query", "close")
+	err := s.CheckSpanOrder("query", "connect")
+	if err == nil || !strings.Contains(err.Error(), `"connect" started before "query"`) || !strings.Contains(err.Error(), "query=+50ns, connect=+0s") {
+		t.Fatalf("expected out of order spans to fail, got %v", err)
+	}
+	if err := s.CheckSpanOrder("connect", "missing"); err == nil {
+		t.Fatal("expected missing span to fail")
+	}
+}
@@ -0,0 +1,61 @@
+package doghouse
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the source of time for the server's timeouts, poll intervals, response delays, and span timestamps. It
+// can be replaced with WithClock so that tests control how time passes.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at a regular interval, it is satisfied by a wrapped *time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the default Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts a *time.Ticker to the Ticker interface.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// withTimeout returns a context that is done once the duration has passed on the server's clock. The context's
+// cause is context.DeadlineExceeded when it times out.
+func (s *MockDatadogServer) withTimeout(d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	after := s.clock.After(d)
+	go func() {
+		select {
+		case <-after:
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel(context.Canceled)
+	}
+}
@@ -0,0 +1,162 @@
+package doghouse
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a channel that receives the time once the clock reaches at, repeating every interval if set.
+type fakeWaiter struct {
+	at       time.Time
+	interval time.Duration
+	ch       chan time.Time
+}
+
+type fakeTicker struct {
+	clock *fakeClock
+	ch    chan time.Time
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, waiter := range t.clock.waiters {
+		if waiter.ch == t.ch {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), interval: d, ch: ch})
+	return fakeTicker{clock: c, ch: ch}
+}
+
+// Advance moves the clock forward, firing every timer and ticker that comes due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		select {
+		case waiter.ch <- c.now:
+		default:
+		}
+		if waiter.interval > 0 {
+			waiter.at = c.now.Add(waiter.interval)
+			pending = append(pending, waiter)
+		}
+	}
+	c.waiters = pending
+}
+
+// awaitWaiters blocks until at least n timers or tickers are waiting on the clock.
+func (c *fakeClock) awaitWaiters(t *testing.T, n int) {
+	t.Helper()
+
+	for i := 0; i < 5000; i++ {
+		c.lock.Lock()
+		waiting := len(c.waiters)
+		c.lock.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters on the clock", n)
+}
+
+func TestWithClock(t *testing.T) {
+	clock := newFakeClock()
+	s := newMockDatadogServer(WithClock(clock), WithPollInterval(0))
+
+	ctx, cancel := s.withTimeout(time.Hour)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- s.AwaitSpan(ctx, "missing")
+	}()
+	clock.awaitWaiters(t, 1)
+	clock.Advance(time.Hour)
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out on the clock, got %v", err)
+	}
+
+	postBatch(t, s, Batch{{{Name: "timed", SpanID: 1}}})
+	if !s.LastSpanTime().Equal(clock.Now()) {
+		t.Fatalf("expected last span time from the clock, got %v", s.LastSpanTime())
+	}
+
+	quiet := make(chan error)
+	go func() {
+		quiet <- s.AwaitQuiescence(context.Background(), time.Minute)
+	}()
+	clock.awaitWaiters(t, 1)
+	clock.Advance(time.Minute)
+	if err := <-quiet; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s.SetResponseDelay(time.Hour)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.ServeHTTP(httptest.NewRecorder(), batchRequest(t, Batch{{{Name: "delayed", SpanID: 2}}}))
+	}()
+	clock.awaitWaiters(t, 1)
+	clock.Advance(time.Hour)
+	<-served
+	s.ExpectSpan(t, "delayed")
+}
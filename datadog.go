@@ -2,38 +2,95 @@ package doghouse
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"testing"
 	"time"
 
+	"github.com/tinylib/msgp/msgp"
+	"google.golang.org/grpc"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
 //go:generate msgp
-//msgp:ignore MockDatadogServer
+//msgp:ignore MockDatadogServer AgentInfo samplingResponse TraceTree subscription ServerMetrics
 
 // Span represents a single span.
 type Span struct {
-	Name     string             `msg:"name"`
-	Service  string             `msg:"service"`
-	Resource string             `msg:"resource"`
-	Type     string             `msg:"type"`
-	Start    int64              `msg:"start"`
-	Duration int64              `msg:"duration"`
-	Meta     map[string]string  `msg:"meta,omitempty"`
-	Metrics  map[string]float64 `msg:"metrics,omitempty"`
-	SpanID   uint64             `msg:"span_id"`
-	TraceID  uint64             `msg:"trace_id"`
-	ParentID uint64             `msg:"parent_id"`
-	Error    int32              `msg:"error"`
+	Name     string             `msg:"name" json:"name"`
+	Service  string             `msg:"service" json:"service"`
+	Resource string             `msg:"resource" json:"resource"`
+	Type     string             `msg:"type" json:"type"`
+	Start    int64              `msg:"start" json:"start"`
+	Duration int64              `msg:"duration" json:"duration"`
+	Meta     map[string]string  `msg:"meta,omitempty" json:"meta,omitempty"`
+	Metrics  map[string]float64 `msg:"metrics,omitempty" json:"metrics,omitempty"`
+	SpanID   uint64             `msg:"span_id" json:"span_id"`
+	TraceID  uint64             `msg:"trace_id" json:"trace_id"`
+	ParentID uint64             `msg:"parent_id" json:"parent_id"`
+	Error    int32              `msg:"error" json:"error"`
+	Links    []SpanLink         `msg:"span_links,omitempty" json:"span_links,omitempty"`
+}
+
+// SpanLink is a reference from a span to a span in another trace, such as the producer of a message that the span
+// consumed.
+type SpanLink struct {
+	TraceID     uint64            `msg:"trace_id" json:"trace_id"`
+	TraceIDHigh uint64            `msg:"trace_id_high,omitempty" json:"trace_id_high,omitempty"`
+	SpanID      uint64            `msg:"span_id" json:"span_id"`
+	Attributes  map[string]string `msg:"attributes,omitempty" json:"attributes,omitempty"`
+	Tracestate  string            `msg:"tracestate,omitempty" json:"tracestate,omitempty"`
+	Flags       uint32            `msg:"flags,omitempty" json:"flags,omitempty"`
+}
+
+// Tag returns the meta tag with the given key and whether it was set.
+func (s Span) Tag(key string) (string, bool) {
+	value, ok := s.Meta[key]
+	return value, ok
+}
+
+// IntTag returns the meta tag with the given key parsed as an integer, such as http.status_code. The boolean
+// return value is false if the tag is not set or is not an integer.
+func (s Span) IntTag(key string) (int, bool) {
+	value, ok := s.Meta[key]
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return i, true
+}
+
+// Metric returns the metric with the given key and whether it was set.
+func (s Span) Metric(key string) (float64, bool) {
+	value, ok := s.Metrics[key]
+	return value, ok
+}
+
+// HasError reports whether the span was marked as errored.
+func (s Span) HasError() bool {
+	return s.Error != 0
 }
 
 // Trace contains a collection of associated spans.
@@ -42,244 +99,1399 @@ type Trace []Span
 // Batch contains a collection of traces sent in bulk to the server.
 type Batch []Trace
 
+// TraceTree is a node in the tree of spans that make up a trace.
+type TraceTree struct {
+	Span     Span
+	Children []*TraceTree
+}
+
+// BuildTraceTree links the given spans together by their ParentID and returns the root nodes sorted by Start.
+// Spans whose parent is not among the given spans are treated as roots. Spans in a parent cycle cannot be reached
+// from any root, so the earliest span of each cycle is detached from its parent and treated as a root as well.
+// Children of each node are also sorted by Start.
+func BuildTraceTree(spans []Span) []*TraceTree {
+	sorted := append([]Span(nil), spans...)
+	sortByStart(sorted)
+
+	nodes := make(map[uint64]*TraceTree, len(sorted))
+	for _, span := range sorted {
+		nodes[span.SpanID] = &TraceTree{Span: span}
+	}
+
+	roots := []*TraceTree{}
+	for _, span := range sorted {
+		node := nodes[span.SpanID]
+		parent, ok := nodes[span.ParentID]
+		if !ok || parent == node {
+			roots = append(roots, node)
+			continue
+		}
+		parent.Children = append(parent.Children, node)
+	}
+
+	reachable := make(map[*TraceTree]bool, len(nodes))
+	for _, root := range roots {
+		markReachable(root, reachable)
+	}
+	promoted := false
+	for _, span := range sorted {
+		node := nodes[span.SpanID]
+		if reachable[node] {
+			continue
+		}
+		parent := nodes[span.ParentID]
+		parent.Children = slices.DeleteFunc(parent.Children, func(child *TraceTree) bool {
+			return child == node
+		})
+		roots = append(roots, node)
+		markReachable(node, reachable)
+		promoted = true
+	}
+	if promoted {
+		sort.SliceStable(roots, func(i, j int) bool {
+			return roots[i].Span.Start < roots[j].Span.Start
+		})
+	}
+	return roots
+}
+
+// markReachable records the node and all of its descendants as reachable.
+func markReachable(node *TraceTree, reachable map[*TraceTree]bool) {
+	if reachable[node] {
+		return
+	}
+	reachable[node] = true
+	for _, child := range node.Children {
+		markReachable(child, reachable)
+	}
+}
+
+// sortByStart sorts the spans in place by their Start time.
+func sortByStart(spans []Span) {
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+}
+
+// AgentInfo is the document returned from the /info endpoint which the tracer uses to discover
+// the features supported by the agent.
+type AgentInfo struct {
+	Version       string   `json:"version"`
+	Endpoints     []string `json:"endpoints"`
+	ClientDropP0s bool     `json:"client_drop_p0s"`
+	FeatureFlags  []string `json:"feature_flags,omitempty"`
+}
+
+// samplingResponse is the body returned from the trace endpoints which the tracer uses to adjust its
+// client-side sampling rates.
+type samplingResponse struct {
+	Rates map[string]float64 `json:"rate_by_service"`
+}
+
+// Logger receives diagnostic output from the server, it is satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
 // MockDatadogServer is a test server that collects traces sent via Datadog's tracing library.
 type MockDatadogServer struct {
-	server      *httptest.Server
-	path        string
-	spansByID   map[uint64]Span
-	spansByName map[string]Span
-	lock        sync.RWMutex
+	server               *httptest.Server
+	otlpServer           *grpc.Server
+	otlpListener         net.Listener
+	otlpEnabled          bool
+	path                 string
+	spans                SpanStore
+	spansByService       map[string][]Span
+	spansByResource      map[string][]Span
+	spansByTrace         map[string][]Span
+	fullTraceIDs         map[uint64][]string
+	childrenByParent     map[uint64][]Span
+	agentInfo            AgentInfo
+	samplingRates        map[string]float64
+	handlers             map[string]http.Handler
+	strictPaths          bool
+	strictTraceCount     bool
+	tlsEnabled           bool
+	warnDurations        bool
+	responseStatus       int
+	errorRate            float64
+	responseDelay        time.Duration
+	tracerOptions        []tracer.StartOption
+	clock                Clock
+	pollInterval         time.Duration
+	waitTimeout          time.Duration
+	noSpanTimeout        time.Duration
+	goldenIgnoreFields   []string
+	normalizationPattern *regexp.Regexp
+	forwardURL           string
+	forwardClient        *http.Client
+	forwards             sync.WaitGroup
+	recordLimit          int
+	recordedRequests     []RecordedRequest
+	logger               Logger
+	decodeErrors         []error
+	spanCount            int
+	traceCount           int
+	batchCount           int
+	batchSizes           []int
+	bytesReceived        int64
+	lastSpanTime         time.Time
+	lastHeaders          http.Header
+	telemetryEvents      []TelemetryEvent
+	clientStats          []ClientStatsPayload
+	subscriptions        map[*subscription]struct{}
+	droppedSpans         int
+	decodeErrorCallbacks []func(error, []byte)
+	spanCallbacks        []func(Span)
+	lock                 sync.RWMutex
+	// cond is broadcast whenever new spans are stored
+	cond *sync.Cond
 }
 
 const (
 	agentEnvVariable = "DD_TRACE_AGENT_URL"
 	traceHeader      = "X-Datadog-Trace-Count"
+	traceIDHighTag   = "_dd.p.tid"
+	spanLinksTag     = "_dd.span_links"
+	priorityMetric   = "_sampling_priority_v1"
 	defaultTracePath = "/v0.4/traces"
+	v05TracePath     = "/v0.5/traces"
+	v03TracePath     = "/v0.3/traces"
+	infoPath         = "/info"
+
+	defaultAgentVersion  = "7.50.0"
+	defaultPollInterval  = 1 * time.Millisecond
+	defaultWaitTimeout   = 10 * time.Millisecond
+	defaultNoSpanTimeout = 100 * time.Millisecond
+	traceSettlePeriod    = 10 * time.Millisecond
+	subscriptionBuffer   = 1024
 )
 
 var initialized atomic.Bool
 
-// New creates a new MockDatadogServer. This should only be ever used as a singleton
-// due to the fact that the Datadog tracer library uses global state for publishing.
+// New creates a new MockDatadogServer that starts the tracer with the given options. Only one server may exist at
+// a time due to the fact that the Datadog tracer library uses global state for publishing, call Destroy before
+// creating another.
 func New(opts ...tracer.StartOption) *MockDatadogServer {
+	return NewWithOptions(WithTracerOptions(opts...))
+}
+
+// NewWithOptions creates a new MockDatadogServer configured with the given options. The same restrictions
+// as New apply.
+func NewWithOptions(opts ...Option) *MockDatadogServer {
 	if !initialized.CompareAndSwap(false, true) {
+		// the options, including the logger, have not been applied yet so this can only use the standard logger
 		log.Fatal("Mocking Datadog is only ever allowed once")
 	}
-	s := &MockDatadogServer{
-		path:        defaultTracePath,
-		spansByID:   make(map[uint64]Span),
-		spansByName: make(map[string]Span),
+	s := newMockDatadogServer(opts...)
+	var tracerOpts []tracer.StartOption
+	if s.tlsEnabled {
+		s.server = httptest.NewTLSServer(s)
+		tracerOpts = append(tracerOpts, tracer.WithHTTPClient(s.server.Client()))
+	} else {
+		s.server = httptest.NewServer(s)
 	}
-	s.server = httptest.NewServer(s)
 	url := s.server.URL
 	os.Setenv(agentEnvVariable, url)
 
-	opts = append(opts, tracer.WithLogStartup(false), tracer.WithPartialFlushing(10))
+	tracerOpts = append(tracerOpts, s.tracerOptions...)
+	tracerOpts = append(tracerOpts, tracer.WithLogStartup(false), tracer.WithPartialFlushing(10))
+
+	if s.otlpEnabled {
+		if err := s.startOTLP(); err != nil {
+			s.logger.Printf("failed to start OTLP listener: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	tracer.Start(tracerOpts...)
+	return s
+}
 
-	tracer.Start(opts...)
+// newMockDatadogServer creates a server with initialized state that is not yet listening.
+func newMockDatadogServer(opts ...Option) *MockDatadogServer {
+	s := &MockDatadogServer{
+		path: defaultTracePath,
+		agentInfo: AgentInfo{
+			Version:   defaultAgentVersion,
+			Endpoints: []string{defaultTracePath, v05TracePath, statsPath},
+		},
+		samplingRates:        make(map[string]float64),
+		handlers:             make(map[string]http.Handler),
+		responseStatus:       http.StatusOK,
+		clock:                realClock{},
+		pollInterval:         defaultPollInterval,
+		spans:                newMapStore(),
+		waitTimeout:          defaultWaitTimeout,
+		noSpanTimeout:        defaultNoSpanTimeout,
+		goldenIgnoreFields:   defaultGoldenIgnoreFields,
+		normalizationPattern: defaultNormalizationPattern,
+		logger:               log.Default(),
+		subscriptions:        make(map[*subscription]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if store, ok := s.spans.(EvictingStore); ok {
+		store.OnEvict(s.evict)
+	}
+	s.cond = sync.NewCond(s.lock.RLocker())
+	s.clear()
 	return s
 }
 
-// SetTracePath changes the url path for which the mock server accepts Datadog traces.
+// URL returns the base URL of the server, which is also exported to the tracer as DD_TRACE_AGENT_URL, so that other
+// clients can send requests to the same server. It is empty if the server is not listening.
+func (s *MockDatadogServer) URL() string {
+	if s.server == nil {
+		return ""
+	}
+	return s.server.URL
+}
+
+// Certificate returns the self-signed certificate of a server created with WithTLS, or nil if the server is not
+// serving TLS.
+func (s *MockDatadogServer) Certificate() *x509.Certificate {
+	if s.server == nil || s.server.TLS == nil {
+		return nil
+	}
+	return s.server.Certificate()
+}
+
+// TLSConfig returns a client TLS configuration that trusts the certificate of a server created with WithTLS, for
+// clients other than the tracer that need to connect to it. It is nil if the server is not serving TLS.
+func (s *MockDatadogServer) TLSConfig() *tls.Config {
+	cert := s.Certificate()
+	if cert == nil {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{RootCAs: pool}
+}
+
+// SetTracePath changes the url path for which the mock server accepts v0.4 encoded Datadog traces. Traces
+// sent to /v0.5/traces and /v0.3/traces are always decoded using the v0.5 and legacy v0.3 formats.
 func (s *MockDatadogServer) SetTracePath(path string) {
 	s.path = path
 }
 
-// Close the underlying test server.
+// SetAgentInfo changes the document returned from the /info endpoint. The tracer only queries the
+// endpoint when it is started, so this should be followed by a call to tracer.Start to take effect.
+func (s *MockDatadogServer) SetAgentInfo(info AgentInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.agentInfo = info
+}
+
+// SetSamplingRates changes the rate_by_service sampling response returned from the trace endpoints.
+// Rates are keyed by "service:<service>,env:<env>" and the key "service:,env:" sets the default rate.
+// The tracer applies the rates from the response to a flush to spans started afterwards.
+func (s *MockDatadogServer) SetSamplingRates(rates map[string]float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.samplingRates = make(map[string]float64, len(rates))
+	for key, rate := range rates {
+		s.samplingRates[key] = rate
+	}
+}
+
+// SetResponseStatus makes the trace endpoints reject requests with the given status code, such as 500 or 429,
+// instead of accepting them. When an error rate is set only that portion of requests is rejected with the code.
+// Pass http.StatusOK to accept requests again.
+func (s *MockDatadogServer) SetResponseStatus(code int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.responseStatus = code
+}
+
+// SetErrorRate makes the trace endpoints reject a random fraction of requests, between 0 and 1, with the status
+// set by SetResponseStatus or 500 if none was set. Pass 0 to stop rejecting requests.
+//
+// The trace count header of a rejected request is still validated, but its body is never decoded so none of its
+// spans are stored.
+func (s *MockDatadogServer) SetErrorRate(fraction float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.errorRate = fraction
+}
+
+// SetResponseDelay makes the trace endpoints wait for the given duration before writing the response status to
+// simulate a slow agent. Spans are still decoded and stored once the delay has passed, unless the client gives up
+// on the request first. Pass 0 to respond immediately.
+func (s *MockDatadogServer) SetResponseDelay(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.responseDelay = d
+}
+
+// delay waits for the configured response delay, returning false if the request's context is done first.
+func (s *MockDatadogServer) delay(r *http.Request) bool {
+	s.lock.RLock()
+	d := s.responseDelay
+	s.lock.RUnlock()
+
+	if d <= 0 {
+		return true
+	}
+
+	select {
+	case <-s.clock.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// rejectStatus returns the status code to reject a trace request with or 0 if it should be accepted.
+func (s *MockDatadogServer) rejectStatus() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	status := s.responseStatus
+	if s.errorRate > 0 {
+		if rand.Float64() >= s.errorRate {
+			return 0
+		}
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+	}
+	if status == http.StatusOK {
+		return 0
+	}
+	return status
+}
+
+// Close the underlying test server and the OTLP listener if one was started, waiting for any requests still being
+// forwarded with WithForward to finish.
 func (s *MockDatadogServer) Close() {
-	s.server.Close()
+	if s.server != nil {
+		s.server.Close()
+	}
+	s.forwards.Wait()
+	if s.otlpServer != nil {
+		s.otlpServer.Stop()
+	}
+}
+
+// Destroy closes the underlying test server, stops the global tracer, and unsets the agent
+// environment variable so that a subsequent call to New can succeed.
+func (s *MockDatadogServer) Destroy() {
+	tracer.Stop()
+	s.Close()
+	os.Unsetenv(agentEnvVariable)
+	initialized.Store(false)
+}
+
+// Shutdown gracefully tears down the server so that the spans from a final flush are not lost. In order, it
+// flushes the tracer, waits until no spans have been received for a short settle period or the context is done,
+// stops the tracer, which sends any remaining traces while the server is still listening, and then destroys the
+// server as Destroy does. Received spans remain available for assertions afterwards. The server is destroyed even
+// if the context is done first, in which case the context's error is returned.
+func (s *MockDatadogServer) Shutdown(ctx context.Context) error {
+	tracer.Flush()
+	err := s.AwaitQuiescence(ctx, traceSettlePeriod)
+	s.Destroy()
+	return err
 }
 
 // ServeHTTP is the main handler for requests from the tracing library.
 func (s *MockDatadogServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	switch r.URL.Path {
+	case infoPath:
+		s.serveInfo(w)
+		return
+	case statsPath:
+		s.serveStats(w, r)
+		return
+	}
 
-	if r.URL.Path != s.path {
+	var decode func([]byte) (Batch, error)
+	switch r.URL.Path {
+	case s.path:
+		decode = unmarshalV04
+	case v05TracePath:
+		decode = unmarshalV05
+	case v03TracePath:
+		decode = unmarshalV03
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			decode = unmarshalV03JSON
+		}
+	default:
+		s.serveOther(w, r)
 		return
 	}
 
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	s.lastHeaders = r.Header.Clone()
+	s.lock.Unlock()
 
-	traceCountHeader := r.Header.Get(traceHeader)
-	if traceCountHeader == "" {
-		log.Print("trace count not passed as a header")
+	original, err := s.bufferBody(r)
+	if err != nil {
+		s.writeSamplingRates(w)
+		s.decodeFailed(fmt.Errorf("failed to get body: %w", err), nil)
 		return
 	}
+	s.record(r, original)
 
-	traceCount, err := strconv.Atoi(traceCountHeader)
-	if err != nil {
-		log.Printf("failed to parse trace count %+v", err)
+	traceCount, err := readTraceCount(r)
+	if err != nil && !(errors.Is(err, errNoTraceCount) && r.ContentLength == 0) {
+		s.writeSamplingRates(w)
+		s.decodeFailed(err, nil)
 		return
 	}
 
-	buf := &bytes.Buffer{}
-	_, err = io.Copy(buf, r.Body)
-	if err != nil {
-		log.Printf("failed to get body %+v", err)
+	if !s.delay(r) {
 		return
 	}
 
+	if status := s.rejectStatus(); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	s.writeSamplingRates(w)
+
 	var batch Batch
-	_, err = batch.UnmarshalMsg(buf.Bytes())
+	var body []byte
+	if r.URL.Path == s.path && original == nil && !s.hasDecodeErrorCallbacks() {
+		batch, err = s.streamBatch(r, traceCount)
+	} else {
+		batch, body, err = s.readBatch(r, traceCount, decode)
+	}
 	if err != nil {
-		log.Printf("failed to parse trace %+v", err)
-		log.Print(buf)
+		s.decodeFailed(err, body)
 		return
 	}
-
-	if len(batch) != traceCount {
-		log.Printf("invalid trace count %d, expected %d", len(batch), traceCount)
+	if len(batch) == 0 {
 		return
 	}
 
+	s.ingest(batch)
+	s.forward(r, original)
+}
+
+// ingest stores every span in the batch, wakes any waiting assertions, and then warns about non-positive durations
+// if enabled and notifies the span callbacks.
+func (s *MockDatadogServer) ingest(batch Batch) {
+	s.lock.Lock()
+	for _, trace := range batch {
+		traceID := chunkTraceID(trace)
+		for _, span := range trace {
+			s.storeInTrace(span, traceID)
+		}
+	}
+	s.batchCount++
+	s.batchSizes = append(s.batchSizes, len(batch))
+	s.traceCount += len(batch)
+	callbacks := s.spanCallbacks
+	dropped := s.droppedSpans
+	s.droppedSpans = 0
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if dropped > 0 {
+		s.logger.Printf("subscriber is not keeping up, dropped %d spans", dropped)
+	}
+
 	for _, trace := range batch {
 		for _, span := range trace {
-			span := span
-			s.spansByID[span.SpanID] = span
-			s.spansByName[span.Name] = span
+			if s.warnDurations && span.Duration <= 0 {
+				s.logger.Printf("received span %q with non-positive duration %v", span.Name, time.Duration(span.Duration))
+			}
+			for _, callback := range callbacks {
+				callback(span)
+			}
 		}
 	}
 }
 
-func (s *MockDatadogServer) spanNames() []string {
-	names := []string{}
-	for _, s := range s.spansByID {
-		names = append(names, s.Name)
+// serveOther dispatches a request for a path other than the trace, stats, and info endpoints to its registered
+// handler, responding with 200, or 404 when strict paths are enabled, if there is none.
+func (s *MockDatadogServer) serveOther(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	handler, ok := s.handlers[r.URL.Path]
+	s.lock.RUnlock()
+
+	if !ok {
+		if s.strictPaths {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
 	}
-	sort.Strings(names)
-	return names
+	handler.ServeHTTP(w, r)
 }
 
-// WaitForSpan waits 10 milliseconds for the server to receive the named span with optional parent matching.
-func (s *MockDatadogServer) WaitForSpan(t *testing.T, name string, parents ...string) {
-	s.WaitDurationForSpan(t, 10*time.Millisecond, name, parents...)
+// Handle registers a handler for requests to the given path, such as /profiling/v1/input, which otherwise receive
+// an empty 200 response. The trace, stats, and /info endpoints are always served by the server itself.
+func (s *MockDatadogServer) Handle(path string, handler http.Handler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handlers[path] = handler
 }
 
-// WaitDurationForSpan waits a sepecified duration for the server to receive the named span with optional parent matching.
-func (s *MockDatadogServer) WaitDurationForSpan(t *testing.T, duration time.Duration, name string, parents ...string) {
-	timeout := time.After(duration)
-	ticker := time.NewTicker(1 * time.Millisecond)
-	defer ticker.Stop()
+// writeSamplingRates writes the rate_by_service response for a trace request.
+func (s *MockDatadogServer) writeSamplingRates(w http.ResponseWriter) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	expectation := func() bool {
-		s.lock.RLock()
-		defer s.lock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(samplingResponse{Rates: s.samplingRates}); err != nil {
+		s.logger.Printf("failed to write sampling rates %+v", err)
+	}
+}
 
-		span, ok := s.spansByName[name]
-		if !ok {
-			return false
+// errNoTraceCount is returned by readTraceCount when the request has no trace count header, which is only an error
+// when the request has a body.
+var errNoTraceCount = errors.New("trace count not passed as a header")
+
+// readTraceCount returns the number of traces the request declares in its trace count header.
+func readTraceCount(r *http.Request) (int, error) {
+	traceCountHeader := r.Header.Get(traceHeader)
+	if traceCountHeader == "" {
+		return 0, errNoTraceCount
+	}
+
+	traceCount, err := strconv.Atoi(traceCountHeader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse trace count: %w", err)
+	}
+	return traceCount, nil
+}
+
+// bufferPool holds the buffers that request bodies are read into. Decoding copies every string out of the body,
+// so a buffer is returned to the pool as soon as its batch has been decoded.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// gzipReaderPool holds the readers used to decompress gzip encoded request bodies.
+var gzipReaderPool sync.Pool
+
+// readBatch reads the request body into a pooled buffer, decompressing it if it is gzip encoded, and decodes it
+// into a batch, which must match the trace count when strict trace counts are enabled. An empty body is an empty
+// batch. It is used for formats that can only be decoded from a full body and whenever the raw body is needed, a
+// copy of which is returned on failure once it has been read, otherwise v0.4 bodies are decoded by streamBatch.
+func (s *MockDatadogServer) readBatch(r *http.Request, traceCount int, decode func([]byte) (Batch, error)) (Batch, []byte, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzipReader(r.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read gzip body: %w", err)
 		}
+		defer gzipReaderPool.Put(gz)
+		body = gz
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	if _, err := buf.ReadFrom(body); err != nil {
+		return nil, nil, fmt.Errorf("failed to get body: %w", err)
+	}
+
+	s.lock.Lock()
+	s.bytesReceived += int64(buf.Len())
+	s.lock.Unlock()
+
+	if buf.Len() == 0 {
+		return nil, nil, nil
+	}
+
+	batch, err := decode(buf.Bytes())
+	if err != nil {
+		s.logger.Printf("%s", buf)
+		return nil, bytes.Clone(buf.Bytes()), fmt.Errorf("failed to parse trace: %w", err)
+	}
+
+	if err := s.checkTraceCount(batch, traceCount); err != nil {
+		return nil, bytes.Clone(buf.Bytes()), err
+	}
 
-		current := span
-		for _, parent := range parents {
-			p, ok := s.spansByID[current.ParentID]
-			if !ok {
-				t.Fatalf("parent span for %q not found", current.Name)
+	s.decodeLinks(batch)
+	return batch, nil, nil
+}
+
+// streamBatch decodes a v0.4 body into a batch as it is read from the request, decompressing it if it is gzip
+// encoded, without first copying the whole body into a buffer. It is only used when nothing needs the raw body, so
+// unlike readBatch the body is neither logged nor returned when it cannot be decoded.
+func (s *MockDatadogServer) streamBatch(r *http.Request, traceCount int) (Batch, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzipReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip body: %w", err)
+		}
+		defer gzipReaderPool.Put(gz)
+		body = gz
+	}
+
+	counter := &countingReader{r: body}
+	var batch Batch
+	err := msgp.Decode(counter, &batch)
+	if _, drainErr := io.Copy(io.Discard, counter); err == nil && drainErr != nil {
+		err = drainErr
+	}
+
+	s.lock.Lock()
+	s.bytesReceived += counter.n
+	s.lock.Unlock()
+
+	if counter.n == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trace: %w", err)
+	}
+	if err := s.checkTraceCount(batch, traceCount); err != nil {
+		return nil, err
+	}
+
+	s.decodeLinks(batch)
+	return batch, nil
+}
+
+// countingReader counts the bytes read through it so that streamed bodies are included in BytesReceived.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// checkTraceCount returns an error if the batch does not match the trace count header and strict trace counts are
+// enabled, otherwise a mismatch is only logged.
+func (s *MockDatadogServer) checkTraceCount(batch Batch, traceCount int) error {
+	if len(batch) == traceCount {
+		return nil
+	}
+	if s.strictTraceCount {
+		return fmt.Errorf("invalid trace count %d, expected %d", len(batch), traceCount)
+	}
+	s.logger.Printf("trace count header declared %d traces but %d were received, storing them anyway", traceCount, len(batch))
+	return nil
+}
+
+// hasDecodeErrorCallbacks reports whether any callbacks registered with OnDecodeError need the raw body of a
+// request that cannot be decoded.
+func (s *MockDatadogServer) hasDecodeErrorCallbacks() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.decodeErrorCallbacks) > 0
+}
+
+// decodeLinks populates the links of spans that carry them as JSON in the _dd.span_links meta tag, which is how
+// tracers send links in formats without a dedicated field. Links that cannot be decoded are logged and skipped.
+func (s *MockDatadogServer) decodeLinks(batch Batch) {
+	for _, trace := range batch {
+		for i := range trace {
+			encoded, ok := trace[i].Meta[spanLinksTag]
+			if !ok || len(trace[i].Links) > 0 {
+				continue
 			}
-			if p.Name != parent {
-				t.Fatalf("parent span %q did not match expected span %q", p.Name, parent)
+			var links []SpanLink
+			if err := json.Unmarshal([]byte(encoded), &links); err != nil {
+				s.logger.Printf("failed to parse span links of %q: %v", trace[i].Name, err)
+				continue
 			}
-			current = p
+			trace[i].Links = links
 		}
+	}
+}
 
-		return true
+// gzipReader returns a pooled reader that decompresses r, or a new one if the pool is empty.
+func gzipReader(r io.Reader) (*gzip.Reader, error) {
+	gz, ok := gzipReaderPool.Get().(*gzip.Reader)
+	if !ok {
+		return gzip.NewReader(r)
 	}
+	if err := gz.Reset(r); err != nil {
+		gzipReaderPool.Put(gz)
+		return nil, err
+	}
+	return gz, nil
+}
 
-	// first check immediately
-	if expectation() {
-		return
+// decodeFailed logs and records a request that could not be decoded and notifies any registered callbacks.
+func (s *MockDatadogServer) decodeFailed(err error, body []byte) {
+	s.logger.Printf("%v", err)
+
+	s.lock.Lock()
+	s.decodeErrors = append(s.decodeErrors, err)
+	callbacks := s.decodeErrorCallbacks
+	s.lock.Unlock()
+
+	for _, callback := range callbacks {
+		callback(err, body)
 	}
+}
 
-	for {
+// OnDecodeError registers a callback invoked with the error and raw body, if it was read, whenever a request to
+// a trace endpoint or /v0.6/stats cannot be decoded. Callbacks are invoked in registration order outside of the
+// server's lock.
+func (s *MockDatadogServer) OnDecodeError(callback func(err error, body []byte)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.decodeErrorCallbacks = append(s.decodeErrorCallbacks, callback)
+}
+
+// OnSpan registers a callback invoked with every span received after the call. Callbacks are invoked in
+// registration order outside of the server's lock once all spans in a batch have been stored.
+func (s *MockDatadogServer) OnSpan(callback func(span Span)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.spanCallbacks = append(s.spanCallbacks, callback)
+}
+
+// DecodeErrors returns every error encountered decoding requests to a trace endpoint or client stats sent to
+// /v0.6/stats, in the order they occurred.
+func (s *MockDatadogServer) DecodeErrors() []error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]error(nil), s.decodeErrors...)
+}
+
+// LastRequestHeaders returns a copy of the headers sent with the most recent request to a trace endpoint,
+// including requests that failed to decode, or nil if none has been received.
+func (s *MockDatadogServer) LastRequestHeaders() http.Header {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.lastHeaders.Clone()
+}
+
+// serveInfo writes the agent info document used for feature negotiation.
+func (s *MockDatadogServer) serveInfo(w http.ResponseWriter) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(s.agentInfo); err != nil {
+		s.logger.Printf("failed to write agent info %+v", err)
+	}
+}
+
+// unmarshalV04 decodes a batch encoded in the v0.4 format where strings are inlined in each span.
+func unmarshalV04(b []byte) (Batch, error) {
+	var batch Batch
+	_, err := batch.UnmarshalMsg(b)
+	return batch, err
+}
+
+// FullTraceID returns the 128-bit trace ID of the span as a 32 character hex string, combining the upper 64 bits
+// from the _dd.p.tid meta tag with the lower 64 bits in TraceID. The upper bits are zero when the tag is absent.
+func FullTraceID(span Span) string {
+	high, _ := strconv.ParseUint(span.Meta[traceIDHighTag], 16, 64)
+	return fmt.Sprintf("%016x%016x", high, span.TraceID)
+}
+
+// chunkTraceID returns the full trace ID of a trace chunk. The tracer only tags the first span of each chunk
+// with the upper bits, so the ID is taken from whichever span in the chunk carries them.
+func chunkTraceID(trace Trace) string {
+	for _, span := range trace {
+		if _, ok := span.Meta[traceIDHighTag]; ok {
+			return FullTraceID(span)
+		}
+	}
+	if len(trace) == 0 {
+		return ""
+	}
+	return FullTraceID(trace[0])
+}
+
+// store adds the span to all indices using the full trace ID from its own meta, the caller must hold the
+// write lock.
+func (s *MockDatadogServer) store(span Span) {
+	s.storeInTrace(span, FullTraceID(span))
+}
+
+// storeInTrace adds the span to all indices under the given full trace ID, the caller must hold the write lock.
+func (s *MockDatadogServer) storeInTrace(span Span, traceID string) {
+	s.spanCount++
+	s.lastSpanTime = s.clock.Now()
+	s.spans.Put(span)
+	s.spansByService[span.Service] = append(s.spansByService[span.Service], span)
+	s.spansByResource[span.Resource] = append(s.spansByResource[span.Resource], span)
+	if _, ok := s.spansByTrace[traceID]; !ok {
+		s.fullTraceIDs[span.TraceID] = append(s.fullTraceIDs[span.TraceID], traceID)
+	}
+	s.spansByTrace[traceID] = append(s.spansByTrace[traceID], span)
+	if span.ParentID != 0 {
+		s.childrenByParent[span.ParentID] = append(s.childrenByParent[span.ParentID], span)
+	}
+
+	for sub := range s.subscriptions {
 		select {
-		case <-timeout:
-			t.Fatalf("unable to find span %q in given time", name)
-		case <-ticker.C:
-			if expectation() {
-				return
-			}
+		case sub.spans <- span:
+		default:
+			s.droppedSpans++
 		}
 	}
 }
 
-// ExpectNoSpan ensures that the named span has not been received within 100 milliseconds.
-func (s *MockDatadogServer) ExpectNoSpan(t *testing.T, name string) {
-	s.ExpectDurationNoSpan(t, 100*time.Millisecond, name)
+// evict drops a span discarded by the store from every other index, the caller must hold the write lock. Spans are
+// evicted in the order they were stored, so the span is the oldest entry under each of its keys.
+func (s *MockDatadogServer) evict(span Span) {
+	dropOldest(s.spansByService, span.Service)
+	dropOldest(s.spansByResource, span.Resource)
+	if span.ParentID != 0 {
+		dropOldest(s.childrenByParent, span.ParentID)
+	}
+	fullIDs := s.fullTraceIDs[span.TraceID]
+	for i, fullID := range fullIDs {
+		if s.spansByTrace[fullID][0].SpanID != span.SpanID {
+			continue
+		}
+		dropOldest(s.spansByTrace, fullID)
+		if _, ok := s.spansByTrace[fullID]; !ok {
+			fullIDs = slices.Delete(fullIDs, i, i+1)
+		}
+		break
+	}
+	if len(fullIDs) == 0 {
+		delete(s.fullTraceIDs, span.TraceID)
+		return
+	}
+	s.fullTraceIDs[span.TraceID] = fullIDs
+}
+
+// subscription is a stream of spans delivered to a subscriber.
+type subscription struct {
+	spans chan Span
 }
 
-// ExpectDurationNoSpan ensures that the named span has not been received in the given duration.
-func (s *MockDatadogServer) ExpectDurationNoSpan(t *testing.T, duration time.Duration, name string) {
-	timeout := time.After(duration)
-	ticker := time.NewTicker(1 * time.Millisecond)
-	defer ticker.Stop()
+// Subscribe returns a channel that receives every span stored after the call along with a function that
+// unsubscribes and closes the channel. The channel is buffered and spans are dropped rather than blocking the
+// server when the subscriber can't keep up, with a single warning logged for each batch that had drops.
+func (s *MockDatadogServer) Subscribe() (<-chan Span, func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	expectation := func() {
-		s.lock.RLock()
-		defer s.lock.RUnlock()
+	sub := &subscription{spans: make(chan Span, subscriptionBuffer)}
+	s.subscriptions[sub] = struct{}{}
 
-		_, ok := s.spansByName[name]
-		if ok {
-			t.Fatalf("unexpected span %q found", name)
+	return sub.spans, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if _, ok := s.subscriptions[sub]; ok {
+			delete(s.subscriptions, sub)
+			close(sub.spans)
 		}
 	}
+}
 
-	// first check immediately
-	expectation()
+func (s *MockDatadogServer) spanNames() []string {
+	names := []string{}
+	for _, span := range s.spans.All() {
+		names = append(names, span.Name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-	for {
-		select {
-		case <-timeout:
-			return
-		case <-ticker.C:
-			expectation()
+// Snapshot returns a deep copy of every received span sorted by Start. Callers are free to modify the returned
+// spans, including their Meta and Metrics maps, without affecting the server.
+func (s *MockDatadogServer) Snapshot() []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.allSpans()
+	for i, span := range spans {
+		spans[i] = copySpan(span)
+	}
+	sortByStart(spans)
+	return spans
+}
+
+// allSpans returns a copy of every received span in the order they were stored, the caller must hold the read
+// lock.
+func (s *MockDatadogServer) allSpans() []Span {
+	return append([]Span(nil), s.spans.All()...)
+}
+
+// copySpan returns a copy of the span that shares no maps with the original.
+func copySpan(span Span) Span {
+	if span.Meta != nil {
+		span.Meta = maps.Clone(span.Meta)
+	}
+	if span.Metrics != nil {
+		span.Metrics = maps.Clone(span.Metrics)
+	}
+	if span.Links != nil {
+		span.Links = slices.Clone(span.Links)
+		for i, link := range span.Links {
+			if link.Attributes != nil {
+				span.Links[i].Attributes = maps.Clone(link.Attributes)
+			}
 		}
 	}
+	return span
+}
+
+// SpanCount returns the total number of spans received.
+func (s *MockDatadogServer) SpanCount() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.spanCount
+}
+
+// TraceCount returns the total number of traces received. A trace that the tracer flushes in multiple
+// chunks is counted once per chunk.
+func (s *MockDatadogServer) TraceCount() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.traceCount
 }
 
-// Expect a named span with the given optional parents to have been received.
-func (s *MockDatadogServer) ExpectSpan(t *testing.T, name string, parents ...string) {
+// BatchCount returns the total number of batches successfully decoded from trace requests.
+func (s *MockDatadogServer) BatchCount() int {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	span, ok := s.spansByName[name]
+	return s.batchCount
+}
+
+// BatchSizes returns the number of traces in each batch successfully decoded from trace requests, in the order they
+// arrived, which shows how the tracer grouped traces into flushes, such as a large trace split by partial flushing.
+func (s *MockDatadogServer) BatchSizes() []int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]int(nil), s.batchSizes...)
+}
+
+// ServerMetrics are counters describing the health of the server itself rather than the spans it received.
+type ServerMetrics struct {
+	Spans         int
+	Traces        int
+	Batches       int
+	DecodeErrors  int
+	BytesReceived int64
+}
+
+// Metrics returns the server's counters, which help diagnose dropped or rejected payloads when many tests share a
+// server. BytesReceived is the size of every trace payload read after decompression, including payloads that
+// failed to decode. The counters are cleared by Reset.
+func (s *MockDatadogServer) Metrics() ServerMetrics {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return ServerMetrics{
+		Spans:         s.spanCount,
+		Traces:        s.traceCount,
+		Batches:       s.batchCount,
+		DecodeErrors:  len(s.decodeErrors),
+		BytesReceived: s.bytesReceived,
+	}
+}
+
+// LastSpanTime returns the wall-clock time at which the most recent span was stored or the zero time if no span
+// has been received since the server was created or reset.
+func (s *MockDatadogServer) LastSpanTime() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.lastSpanTime
+}
+
+// GetSpan returns a deep copy of the most recently received span with the given name and whether one was found.
+func (s *MockDatadogServer) GetSpan(name string) (Span, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return Span{}, false
+	}
+	return copySpan(spans[len(spans)-1]), true
+}
+
+// GetSpanByID returns a deep copy of the most recently received span with the given span ID and whether one was
+// found, such as a parent or child of a span that has already been retrieved.
+func (s *MockDatadogServer) GetSpanByID(id uint64) (Span, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	span, ok := s.spans.ByID(id)
 	if !ok {
-		t.Fatalf("span named %q not found in spans: %v", name, s.spanNames())
+		return Span{}, false
+	}
+	return copySpan(span), true
+}
+
+// GetSpansByName returns a copy of all received spans with the given name in the order they were received.
+func (s *MockDatadogServer) GetSpansByName(name string) []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]Span(nil), s.spans.ByName(name)...)
+}
+
+// GetTrace returns a copy of all received spans with the given 128-bit trace ID, as returned by FullTraceID, sorted
+// by Start. The ID is matched case-insensitively, so traces whose lower 64 bits collide are never merged.
+func (s *MockDatadogServer) GetTrace(traceID string) []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.traceSpans(traceID)
+}
+
+// traceSpans returns a copy of the spans with the given full trace ID sorted by Start, the caller must hold the
+// read lock.
+func (s *MockDatadogServer) traceSpans(traceID string) []Span {
+	spans := append([]Span{}, s.spansByTrace[strings.ToLower(traceID)]...)
+	sortByStart(spans)
+	return spans
+}
+
+// spanTraceID returns the full trace ID the span was stored under, which unlike FullTraceID accounts for spans in a
+// chunk that do not carry the upper trace ID bits themselves. The caller must hold the lock.
+func (s *MockDatadogServer) spanTraceID(span Span) string {
+	fullIDs := s.fullTraceIDs[span.TraceID]
+	for _, fullID := range fullIDs {
+		if slices.ContainsFunc(s.spansByTrace[fullID], func(stored Span) bool { return stored.SpanID == span.SpanID }) {
+			return fullID
+		}
+	}
+	return FullTraceID(span)
+}
+
+// GetTraceTree returns the root nodes of the tree of spans with the given 128-bit trace ID.
+func (s *MockDatadogServer) GetTraceTree(traceID string) []*TraceTree {
+	return BuildTraceTree(s.GetTrace(traceID))
+}
+
+// Dump renders every received span as an indented tree grouped by trace, including the service, resource,
+// duration, and error flag of each span.
+func (s *MockDatadogServer) Dump() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	traces := make([][]*TraceTree, 0, len(s.spansByTrace))
+	for _, spans := range s.spansByTrace {
+		if roots := BuildTraceTree(spans); len(roots) > 0 {
+			traces = append(traces, roots)
+		}
+	}
+	sort.Slice(traces, func(i, j int) bool {
+		a, b := traces[i][0].Span, traces[j][0].Span
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		return a.TraceID < b.TraceID
+	})
+
+	var b strings.Builder
+	for _, roots := range traces {
+		fmt.Fprintf(&b, "trace %d\n", roots[0].Span.TraceID)
+		for _, root := range roots {
+			dumpTree(&b, root, 1)
+		}
+	}
+	return b.String()
+}
+
+func dumpTree(b *strings.Builder, node *TraceTree, depth int) {
+	span := node.Span
+	fmt.Fprintf(b, "%s%s (service=%q, resource=%q, duration=%v", strings.Repeat("  ", depth), span.Name, span.Service, span.Resource, time.Duration(span.Duration))
+	if span.Error != 0 {
+		b.WriteString(", error")
+	}
+	b.WriteString(")\n")
+	for _, child := range node.Children {
+		dumpTree(b, child, depth+1)
+	}
+}
+
+// TraceDOT renders the trace with the given trace ID as a Graphviz DOT graph, which can be piped to dot to visualize
+// its structure. Each node is labeled with the span's name, service, and duration, edges point from parent to
+// child, and errored spans are colored red. The trace is looked up by its 128-bit ID as with GetTrace.
+func (s *MockDatadogServer) TraceDOT(traceID string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph \"trace %s\" {\n\tnode [shape=box];\n", traceID)
+	for _, root := range s.GetTraceTree(traceID) {
+		dotTree(&b, root)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotTree(b *strings.Builder, node *TraceTree) {
+	span := node.Span
+	label := fmt.Sprintf("%s\n%s\n%v", span.Name, span.Service, time.Duration(span.Duration))
+	fmt.Fprintf(b, "\t\"%d\" [label=%q", span.SpanID, label)
+	if span.Error != 0 {
+		b.WriteString(", color=red, fontcolor=red")
+	}
+	b.WriteString("];\n")
+	for _, child := range node.Children {
+		fmt.Fprintf(b, "\t\"%d\" -> \"%d\";\n", span.SpanID, child.Span.SpanID)
+		dotTree(b, child)
+	}
+}
+
+// GetAncestors returns the chain of spans starting at the most recently received span with the given name and
+// walking its parents up to the root. The walk stops at the first parent that has not been received. The boolean
+// return value reports whether a span with the given name was found.
+func (s *MockDatadogServer) GetAncestors(name string) ([]Span, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return nil, false
 	}
 
+	return s.ancestors(spans[len(spans)-1]), true
+}
+
+// ancestors returns the chain of spans starting at the span and walking its parents up to the root, stopping at
+// the first parent that has not been received or that was already visited. The caller must hold the read lock.
+func (s *MockDatadogServer) ancestors(span Span) []Span {
 	current := span
-	for _, parent := range parents {
-		p, ok := s.spansByID[current.ParentID]
+	chain := []Span{current}
+	visited := map[uint64]struct{}{current.SpanID: {}}
+	for current.ParentID != 0 {
+		parent, ok := s.spans.ByID(current.ParentID)
 		if !ok {
-			t.Fatalf("parent span for %q not found", current.Name)
+			break
 		}
-		if p.Name != parent {
-			t.Fatalf("parent span %q did not match expected span %q", p.Name, parent)
+		if _, ok := visited[parent.SpanID]; ok {
+			break
 		}
-		current = p
+		visited[parent.SpanID] = struct{}{}
+		chain = append(chain, parent)
+		current = parent
 	}
+	return chain
 }
 
-// Expect a named span with the given verification function to exist.
-func (s *MockDatadogServer) ExpectSpanFn(t *testing.T, name string, fn func(span Span) bool, msg string, args ...interface{}) {
+// GetSpansMatching returns a copy of all received spans with names matching the pattern sorted by Start.
+func (s *MockDatadogServer) GetSpansMatching(pattern *regexp.Regexp) []Span {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	span, ok := s.spansByName[name]
-	if !ok {
-		t.Fatalf("span named %q not found in spans: %v", name, s.spanNames())
+	spans := []Span{}
+	for _, span := range s.spans.All() {
+		if pattern.MatchString(span.Name) {
+			spans = append(spans, span)
+		}
 	}
+	sortByStart(spans)
+	return spans
+}
+
+// GetChildren returns a copy of all received spans whose parent is the span with the given ID sorted by Start.
+func (s *MockDatadogServer) GetChildren(spanID uint64) []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	children := append([]Span(nil), s.childrenByParent[spanID]...)
+	sortByStart(children)
+	return children
+}
 
-	if !fn(span) {
-		t.Fatalf(msg, args...)
+// GetChildrenByName returns a copy of the children of every received span with the given name sorted by Start.
+func (s *MockDatadogServer) GetChildrenByName(name string) []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	children := []Span{}
+	for _, span := range s.spans.ByName(name) {
+		children = append(children, s.childrenByParent[span.SpanID]...)
 	}
+	sortByStart(children)
+	return children
 }
 
-// Reset the internal state of the server between test runs.
+// GetOrphans returns a copy of every received span whose parent was never received sorted by Start.
+func (s *MockDatadogServer) GetOrphans() []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.orphans()
+}
+
+func (s *MockDatadogServer) orphans() []Span {
+	orphans := []Span{}
+	for _, span := range s.allSpans() {
+		if span.ParentID == 0 {
+			continue
+		}
+		if _, ok := s.spans.ByID(span.ParentID); !ok {
+			orphans = append(orphans, span)
+		}
+	}
+	sortByStart(orphans)
+	return orphans
+}
+
+// GetSpansByService returns a copy of all received spans with the given service in the order they were received.
+func (s *MockDatadogServer) GetSpansByService(service string) []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]Span(nil), s.spansByService[service]...)
+}
+
+// GetSpansByResource returns a copy of all received spans with the given resource in the order they were received.
+func (s *MockDatadogServer) GetSpansByResource(resource string) []Span {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]Span(nil), s.spansByResource[resource]...)
+}
+
+// ResourceCounts returns the number of spans received for each distinct resource.
+func (s *MockDatadogServer) ResourceCounts() map[string]int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	counts := make(map[string]int, len(s.spansByResource))
+	for resource, spans := range s.spansByResource {
+		counts[resource] = len(spans)
+	}
+	return counts
+}
+
+// ErrorCounts returns the number of spans marked as errored that were received for each span name. Names with no
+// errored spans are absent from the map.
+func (s *MockDatadogServer) ErrorCounts() map[string]int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	counts := make(map[string]int)
+	for _, span := range s.spans.All() {
+		if span.Error != 0 {
+			counts[span.Name]++
+		}
+	}
+	return counts
+}
+
+// SpanNamesByService returns the sorted, unique names of the spans received from each service. Services that
+// sent no spans are absent from the map.
+func (s *MockDatadogServer) SpanNamesByService() map[string][]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names := make(map[string][]string, len(s.spansByService))
+	for service, spans := range s.spansByService {
+		unique := make([]string, 0, len(spans))
+		for _, span := range spans {
+			unique = append(unique, span.Name)
+		}
+		sort.Strings(unique)
+		names[service] = slices.Compact(unique)
+	}
+	return names
+}
+
+// Reset the internal state of the server between test runs. Every received span and index built from them, the
+// span, trace, batch, and byte counters, batch sizes, decode errors, recorded requests and headers, telemetry, and
+// stats, and the last span time are cleared. Configuration such as sampling rates and registered callbacks and
+// subscriptions are kept.
 func (s *MockDatadogServer) Reset() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.spansByID = make(map[uint64]Span)
-	s.spansByName = make(map[string]Span)
+	s.clear()
+	s.cond.Broadcast()
+}
+
+// ResetService removes every span reported by the given service from all indices while keeping the spans of other
+// services. Like the trace and batch counters, SpanCount still reflects every span received, as it does when a
+// RingStore evicts spans.
+func (s *MockDatadogServer) ResetService(service string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keep := func(span Span) bool {
+		return span.Service != service
+	}
+
+	spans := s.allSpans()
+	s.spans.Reset()
+	for _, span := range spans {
+		if keep(span) {
+			s.spans.Put(span)
+		}
+	}
+	filterIndex(s.spansByService, keep)
+	filterIndex(s.spansByResource, keep)
+	filterIndex(s.childrenByParent, keep)
+	filterIndex(s.spansByTrace, keep)
+	for traceID, fullIDs := range s.fullTraceIDs {
+		fullIDs = slices.DeleteFunc(fullIDs, func(fullID string) bool {
+			_, ok := s.spansByTrace[fullID]
+			return !ok
+		})
+		if len(fullIDs) == 0 {
+			delete(s.fullTraceIDs, traceID)
+			continue
+		}
+		s.fullTraceIDs[traceID] = fullIDs
+	}
+	s.cond.Broadcast()
+}
+
+// filterIndex removes the spans that should not be kept from every entry of the index, deleting entries that
+// become empty.
+func filterIndex[K comparable](index map[K][]Span, keep func(span Span) bool) {
+	for key, spans := range index {
+		spans = slices.DeleteFunc(spans, func(span Span) bool {
+			return !keep(span)
+		})
+		if len(spans) == 0 {
+			delete(index, key)
+			continue
+		}
+		index[key] = spans
+	}
+}
+
+// clear resets all indices, the caller must hold the write lock.
+func (s *MockDatadogServer) clear() {
+	s.spans.Reset()
+	s.spansByService = make(map[string][]Span)
+	s.spansByResource = make(map[string][]Span)
+	s.spansByTrace = make(map[string][]Span)
+	s.fullTraceIDs = make(map[uint64][]string)
+	s.childrenByParent = make(map[uint64][]Span)
+	s.decodeErrors = nil
+	s.spanCount = 0
+	s.traceCount = 0
+	s.batchCount = 0
+	s.batchSizes = nil
+	s.bytesReceived = 0
+	s.lastSpanTime = time.Time{}
+	s.lastHeaders = nil
+	s.recordedRequests = nil
+	s.telemetryEvents = nil
+	s.clientStats = nil
 }
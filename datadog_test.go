@@ -1,10 +1,26 @@
 package doghouse
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
@@ -12,11 +28,31 @@ var server *MockDatadogServer
 
 func TestMain(m *testing.M) {
 	server = New()
+	warmup()
 	ret := m.Run()
 	server.Close()
 	os.Exit(ret)
 }
 
+// warmup sends a span through the tracer and waits for it to arrive so that the tracer's initial
+// connection latency doesn't count against the short default timeouts used in tests.
+func warmup() {
+	span := tracer.StartSpan("test.warmup")
+	span.Finish()
+	tracer.Flush()
+
+	for i := 0; i < 5000; i++ {
+		server.lock.RLock()
+		ok := server.hasSpan("test.warmup")
+		server.lock.RUnlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	server.Reset()
+}
+
 func TestExpectSpanFn(t *testing.T) {
 	t.Parallel()
 
@@ -61,6 +97,79 @@ func TestReset(t *testing.T) {
 	server.ExpectNoSpan(t, "test.reset")
 }
 
+func TestResetClearsEverything(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging())
+	postBatch(t, s, Batch{{
+		{Name: "root", Service: "web", Resource: "GET /", SpanID: 1, TraceID: 1},
+		{Name: "child", Service: "db", Resource: "SELECT 1", SpanID: 2, TraceID: 1, ParentID: 1},
+	}})
+	s.store(Span{Name: "orphan", SpanID: 3, TraceID: 2, ParentID: 99})
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, defaultTracePath, http.NoBody))
+
+	s.Reset()
+
+	if s.SpanCount() != 0 || s.TraceCount() != 0 || s.BatchCount() != 0 {
+		t.Fatalf("unexpected counts after reset: spans=%d, traces=%d, batches=%d", s.SpanCount(), s.TraceCount(), s.BatchCount())
+	}
+	if len(s.Snapshot()) != 0 || len(s.spanNames()) != 0 || s.HasSpan("root") {
+		t.Fatalf("expected no spans after reset, got %+v", s.Snapshot())
+	}
+	if len(s.GetSpansByName("root")) != 0 || len(s.GetSpansByService("web")) != 0 || len(s.GetSpansByResource("GET /")) != 0 {
+		t.Fatal("expected name, service, and resource indices to be cleared")
+	}
+	if len(s.GetTrace(hexTraceID(1))) != 0 || len(s.GetChildren(1)) != 0 {
+		t.Fatal("expected trace and children indices to be cleared")
+	}
+	if len(s.GetOrphans()) != 0 || len(s.ResourceCounts()) != 0 || s.Dump() != "" {
+		t.Fatal("expected derived views to be empty")
+	}
+	if len(s.DecodeErrors()) != 0 || s.LastRequestHeaders() != nil || !s.LastSpanTime().IsZero() {
+		t.Fatal("expected decode errors, headers, and last span time to be cleared")
+	}
+}
+
+func TestResetService(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "request", Service: "web", Resource: "GET /", SpanID: 1, TraceID: 1},
+		{Name: "query", Service: "db", Resource: "SELECT 1", SpanID: 2, TraceID: 1, ParentID: 1},
+	}, {
+		{Name: "query", Service: "db", Resource: "SELECT 1", SpanID: 3, TraceID: 2},
+	}})
+
+	s.ResetService("db")
+
+	if s.SpanCount() != 3 || s.HasSpan("query") || len(s.GetSpansByService("db")) != 0 || len(s.GetSpansByResource("SELECT 1")) != 0 {
+		t.Fatalf("expected db spans to be removed, got %+v", s.Snapshot())
+	}
+	if len(s.GetChildren(1)) != 0 || len(s.GetTrace(hexTraceID(2))) != 0 {
+		t.Fatal("expected children and trace indices to be consistent")
+	}
+	if trace := s.GetTrace(hexTraceID(1)); len(trace) != 1 || trace[0].Name != "request" {
+		t.Fatalf("unexpected remaining trace: %+v", trace)
+	}
+	s.ExpectSpanWithService(t, "request", "web")
+	s.ExpectLeafSpan(t, "request")
+}
+
+func TestResetServiceAfterEviction(t *testing.T) {
+	s := newMockDatadogServer(WithStore(NewRingStore(2)))
+	postBatch(t, s, Batch{{{Name: "a", Service: "x", SpanID: 1}}})
+	postBatch(t, s, Batch{{{Name: "b", Service: "x", SpanID: 2}}})
+	postBatch(t, s, Batch{{{Name: "c", Service: "x", SpanID: 3}}})
+
+	s.ResetService("x")
+	postBatch(t, s, Batch{{{Name: "d", Service: "y", SpanID: 4}}})
+	postBatch(t, s, Batch{{{Name: "e", Service: "y", SpanID: 5}}})
+
+	if count := s.SpanCount(); count != 5 {
+		t.Fatalf("expected every received span to be counted, got %d", count)
+	}
+	if spans := s.GetSpansByService("y"); len(spans) != 2 {
+		t.Fatalf("expected the spans received after the reset to be stored, got %+v", spans)
+	}
+}
+
 func TestSpanNames(t *testing.T) {
 	one := tracer.StartSpan("1")
 	two := tracer.StartSpan("2", tracer.ChildOf(one.Context()))
@@ -78,3 +187,1178 @@ func TestSpanNames(t *testing.T) {
 		t.Fatalf("expected span names didn't match: %+v", server.spanNames())
 	}
 }
+
+func TestGetSpansByName(t *testing.T) {
+	t.Parallel()
+
+	first := tracer.StartSpan("test.getspansbyname", tracer.ResourceName("first"))
+	second := tracer.StartSpan("test.getspansbyname", tracer.ResourceName("second"), tracer.ChildOf(first.Context()))
+	second.Finish()
+	first.Finish()
+	tracer.Flush()
+
+	server.WaitForSpan(t, "test.getspansbyname")
+	server.ExpectSpanFn(t, "test.getspansbyname", func(span Span) bool {
+		return span.Resource == "first"
+	}, "first span not found")
+	server.ExpectSpanFn(t, "test.getspansbyname", func(span Span) bool {
+		return span.Resource == "second"
+	}, "second span not found")
+
+	spans := server.GetSpansByName("test.getspansbyname")
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+}
+
+func TestExpectSpanCount(t *testing.T) {
+	t.Parallel()
+
+	root := tracer.StartSpan("test.expectspancount.root")
+	for i := 0; i < 3; i++ {
+		tracer.StartSpan("test.expectspancount", tracer.ChildOf(root.Context())).Finish()
+	}
+	root.Finish()
+	tracer.Flush()
+
+	server.WaitForSpanCount(t, "test.expectspancount", 3)
+	server.ExpectSpanCount(t, "test.expectspancount", 3)
+	server.ExpectSpanCount(t, "test.expectspancount.root", 1)
+	server.ExpectSpanCount(t, "test.expectspancount.missing", 0)
+}
+
+func TestGetSpansByService(t *testing.T) {
+	t.Parallel()
+
+	root := tracer.StartSpan("test.getspansbyservice", tracer.ServiceName("test.getspansbyservice.db"))
+	tracer.StartSpan("test.getspansbyservice", tracer.ServiceName("test.getspansbyservice.cache"), tracer.ChildOf(root.Context())).Finish()
+	root.Finish()
+	tracer.Flush()
+
+	server.WaitForSpanCount(t, "test.getspansbyservice", 2)
+	server.ExpectSpanWithService(t, "test.getspansbyservice", "test.getspansbyservice.db")
+	server.ExpectSpanWithService(t, "test.getspansbyservice", "test.getspansbyservice.cache")
+
+	spans := server.GetSpansByService("test.getspansbyservice.cache")
+	if len(spans) != 1 || spans[0].Name != "test.getspansbyservice" {
+		t.Fatalf("unexpected spans for service: %+v", spans)
+	}
+}
+
+func TestGetSpansByResource(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "sql.query", Resource: "SELECT * FROM users WHERE id = ?", SpanID: 1})
+	s.store(Span{Name: "sql.query", Resource: "SELECT * FROM users WHERE id = ?", SpanID: 2})
+	s.store(Span{Name: "sql.query", Resource: "DELETE FROM users", SpanID: 3})
+
+	spans := s.GetSpansByResource("SELECT * FROM users WHERE id = ?")
+	if len(spans) != 2 || spans[0].SpanID != 1 || spans[1].SpanID != 2 {
+		t.Fatalf("unexpected spans for resource: %+v", spans)
+	}
+
+	counts := s.ResourceCounts()
+	if len(counts) != 2 || counts["SELECT * FROM users WHERE id = ?"] != 2 || counts["DELETE FROM users"] != 1 {
+		t.Fatalf("unexpected resource counts: %v", counts)
+	}
+}
+
+func TestGetSpan(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "op", SpanID: 1, Meta: map[string]string{"attempt": "1"}})
+	s.store(Span{Name: "op", SpanID: 2, Meta: map[string]string{"attempt": "2"}, Metrics: map[string]float64{"rows": 1}})
+
+	span, ok := s.GetSpan("op")
+	if !ok || span.SpanID != 2 {
+		t.Fatalf("expected the most recent span, got %+v", span)
+	}
+	span.Meta["attempt"] = "changed"
+	span.Metrics["rows"] = 2
+	if stored, _ := s.GetSpan("op"); stored.Meta["attempt"] != "2" || stored.Metrics["rows"] != 1 {
+		t.Fatalf("expected a deep copy, stored span changed to %+v", stored)
+	}
+
+	if _, ok := s.GetSpan("missing"); ok {
+		t.Fatal("unexpected span")
+	}
+}
+
+func TestGetSpanByID(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "op", SpanID: 1, Meta: map[string]string{"attempt": "1"}})
+	s.store(Span{Name: "op", SpanID: 2, ParentID: 1})
+
+	span, ok := s.GetSpanByID(1)
+	if !ok || span.Name != "op" || span.Meta["attempt"] != "1" {
+		t.Fatalf("unexpected span: %+v", span)
+	}
+	span.Meta["attempt"] = "changed"
+	if stored, _ := s.GetSpanByID(1); stored.Meta["attempt"] != "1" {
+		t.Fatalf("expected a deep copy, stored span changed to %+v", stored)
+	}
+
+	s.ExpectSpanByID(t, 2)
+	if err := s.CheckSpanByID(3); err == nil {
+		t.Fatal("expected missing span to fail")
+	}
+}
+
+func TestSpanNamesByService(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "http.request", Service: "web", SpanID: 1})
+	s.store(Span{Name: "render", Service: "web", SpanID: 2})
+	s.store(Span{Name: "http.request", Service: "web", SpanID: 3})
+	s.store(Span{Name: "query", Service: "db", SpanID: 4})
+
+	expected := map[string][]string{"web": {"http.request", "render"}, "db": {"query"}}
+	if names := s.SpanNamesByService(); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected names by service: %v", names)
+	}
+}
+
+func TestExpectSpanMeta(t *testing.T) {
+	t.Parallel()
+
+	span := tracer.StartSpan("test.expectspanmeta", tracer.Tag("http.method", "GET"), tracer.Tag("env", "staging"))
+	span.Finish()
+	tracer.Flush()
+
+	server.WaitForSpan(t, "test.expectspanmeta")
+	server.ExpectSpanMeta(t, "test.expectspanmeta", map[string]string{
+		"http.method": "GET",
+		"env":         "staging",
+	})
+}
+
+func TestExpectSpanMetric(t *testing.T) {
+	t.Parallel()
+
+	span := tracer.StartSpan("test.expectspanmetric", tracer.Tag("histogram", 10.25))
+	span.Finish()
+	tracer.Flush()
+
+	server.WaitForSpan(t, "test.expectspanmetric")
+	server.ExpectSpanMetric(t, "test.expectspanmetric", "histogram", 10.2, 0.1)
+}
+
+func TestExpectErrorSpan(t *testing.T) {
+	t.Parallel()
+
+	root := tracer.StartSpan("test.expecterrorspan.ok")
+	child := tracer.StartSpan("test.expecterrorspan", tracer.ChildOf(root.Context()))
+	child.Finish(tracer.WithError(errors.New("boom")))
+	root.Finish()
+	tracer.Flush()
+
+	server.WaitForSpan(t, "test.expecterrorspan")
+	server.ExpectErrorSpan(t, "test.expecterrorspan")
+	server.ExpectNoErrorSpan(t, "test.expecterrorspan.ok")
+	server.ExpectSpanMeta(t, "test.expecterrorspan", map[string]string{
+		ext.ErrorMsg: "boom",
+	})
+}
+
+func TestExpectSpanLink(t *testing.T) {
+	t.Parallel()
+
+	producer := tracer.StartSpan("test.expectspanlink.producer")
+	producer.Finish()
+	tracer.Flush()
+	link := ddtrace.SpanLink{TraceID: producer.Context().TraceID(), SpanID: producer.Context().SpanID()}
+	consumer := tracer.StartSpan("test.expectspanlink.consumer", tracer.WithSpanLinks([]ddtrace.SpanLink{link}))
+	consumer.Finish()
+	tracer.Flush()
+
+	server.WaitDurationForSpan(t, 5*time.Second, "test.expectspanlink.consumer")
+	server.ExpectSpanLink(t, "test.expectspanlink.consumer", link.TraceID, link.SpanID)
+	if err := server.CheckSpanLink("test.expectspanlink.producer", link.TraceID, link.SpanID); err == nil {
+		t.Fatal("expected span without links to fail")
+	}
+}
+
+func TestSpanLinksFromMeta(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "consumer", SpanID: 1, Meta: map[string]string{spanLinksTag: `[{"trace_id":10,"span_id":20,"attributes":{"kind":"producer"}}]`}},
+		{Name: "invalid", SpanID: 2, Meta: map[string]string{spanLinksTag: `not json`}},
+	}})
+
+	s.ExpectSpanLink(t, "consumer", 10, 20)
+	span, _ := s.GetSpan("consumer")
+	if span.Links[0].Attributes["kind"] != "producer" {
+		t.Fatalf("expected link attributes to be decoded, got %+v", span.Links)
+	}
+	err := s.CheckSpanLink("consumer", 10, 21)
+	if err == nil || !strings.Contains(err.Error(), "[10/20]") {
+		t.Fatalf("expected found links to be listed, got: %v", err)
+	}
+	s.ExpectSpan(t, "invalid")
+}
+
+func TestURL(t *testing.T) {
+	if url := server.URL(); url == "" || url != os.Getenv(agentEnvVariable) {
+		t.Fatalf("expected the url %q to match %s=%q", url, agentEnvVariable, os.Getenv(agentEnvVariable))
+	}
+
+	resp, err := http.Get(server.URL() + infoPath)
+	if err != nil {
+		t.Fatalf("failed to request agent info: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	if url := newMockDatadogServer().URL(); url != "" {
+		t.Fatalf("expected a server that is not listening to have no url, got %q", url)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	server.Destroy()
+	if _, ok := os.LookupEnv(agentEnvVariable); ok {
+		t.Fatalf("expected %s to be unset", agentEnvVariable)
+	}
+
+	server = New()
+	warmup()
+
+	span := tracer.StartSpan("test.destroy")
+	span.Finish()
+	tracer.Flush()
+
+	server.WaitDurationForSpan(t, time.Second, "test.destroy")
+}
+
+func TestShutdown(t *testing.T) {
+	defer func() {
+		server = New()
+		warmup()
+	}()
+
+	span := tracer.StartSpan("test.shutdown")
+	span.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+	if _, ok := os.LookupEnv(agentEnvVariable); ok {
+		t.Fatalf("expected %s to be unset", agentEnvVariable)
+	}
+	server.ExpectSpan(t, "test.shutdown")
+}
+
+func TestWithTLS(t *testing.T) {
+	server.Destroy()
+	server = NewWithOptions(WithTLS())
+	defer func() {
+		server.Destroy()
+		server = New()
+		warmup()
+	}()
+	warmup()
+
+	if !strings.HasPrefix(server.URL(), "https://") || os.Getenv(agentEnvVariable) != server.URL() {
+		t.Fatalf("expected %s to be set to an https url, got %q", agentEnvVariable, os.Getenv(agentEnvVariable))
+	}
+
+	span := tracer.StartSpan("test.withtls")
+	span.Finish()
+	tracer.Flush()
+	server.WaitDurationForSpan(t, time.Second, "test.withtls")
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: server.TLSConfig()}}
+	resp, err := client.Get(server.URL() + infoPath)
+	if err != nil {
+		t.Fatalf("failed to request agent info over tls: %v", err)
+	}
+	resp.Body.Close()
+
+	if s := newMockDatadogServer(); s.Certificate() != nil || s.TLSConfig() != nil {
+		t.Fatal("expected a server without tls to have no certificate")
+	}
+}
+
+func TestAgentInfo(t *testing.T) {
+	s := newMockDatadogServer()
+
+	info := func() AgentInfo {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/info", nil))
+
+		var info AgentInfo
+		if err := json.NewDecoder(recorder.Body).Decode(&info); err != nil {
+			t.Fatalf("failed to decode agent info: %v", err)
+		}
+		return info
+	}
+
+	if actual := info(); !slices.Contains(actual.Endpoints, "/v0.4/traces") || actual.Version == "" {
+		t.Fatalf("unexpected default agent info: %+v", actual)
+	}
+
+	s.SetAgentInfo(AgentInfo{Version: "1.2.3", Endpoints: []string{"/v0.4/traces", "/v0.6/stats"}})
+	if actual := info(); actual.Version != "1.2.3" || !slices.Equal(actual.Endpoints, []string{"/v0.4/traces", "/v0.6/stats"}) {
+		t.Fatalf("unexpected agent info: %+v", actual)
+	}
+}
+
+func TestSamplingRatesResponse(t *testing.T) {
+	s := newMockDatadogServer()
+	s.SetSamplingRates(map[string]float64{"service:foo,env:bar": 0.5})
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v0.4/traces", nil))
+
+	var response struct {
+		Rates map[string]float64 `json:"rate_by_service"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode sampling response: %v", err)
+	}
+	if response.Rates["service:foo,env:bar"] != 0.5 {
+		t.Fatalf("unexpected sampling rates: %+v", response.Rates)
+	}
+}
+
+func TestSamplingRates(t *testing.T) {
+	server.SetSamplingRates(map[string]float64{"service:test.samplingrates,env:": 0})
+	defer server.SetSamplingRates(nil)
+
+	// the tracer applies rates from the response of a flush to spans started after
+	// it is processed, so keep flushing until a span picks up the rejected rate
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 1; time.Now().Before(deadline); i++ {
+		span := tracer.StartSpan("test.samplingrates", tracer.ServiceName("test.samplingrates"))
+		span.Finish()
+		tracer.Flush()
+
+		server.WaitDurationForSpanCount(t, time.Second, "test.samplingrates", i)
+		spans := server.GetSpansByName("test.samplingrates")
+		if priority, ok := spans[len(spans)-1].Metrics[priorityMetric]; ok && priority == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("tracer never applied the sampling rate")
+}
+
+func TestExpectSamplingPriority(t *testing.T) {
+	t.Parallel()
+
+	span := tracer.StartSpan("test.expectsamplingpriority", tracer.Tag(ext.ManualKeep, true))
+	span.Finish()
+	tracer.Flush()
+
+	server.WaitForSpan(t, "test.expectsamplingpriority")
+	server.ExpectSamplingPriority(t, "test.expectsamplingpriority", ext.PriorityUserKeep)
+	if err := server.CheckSamplingPriority("test.expectsamplingpriority", ext.PriorityUserReject); err == nil {
+		t.Fatal("expected mismatched priority to fail")
+	}
+
+	s := newMockDatadogServer()
+	s.store(Span{Name: "unsampled", SpanID: 1})
+	if err := s.CheckSamplingPriority("unsampled", ext.PriorityAutoKeep); err == nil {
+		t.Fatal("expected a span without a priority to fail")
+	}
+}
+
+func TestGetAncestors(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "root", SpanID: 1})
+	s.store(Span{Name: "middle", SpanID: 2, ParentID: 1})
+	s.store(Span{Name: "leaf", SpanID: 3, ParentID: 2})
+	s.store(Span{Name: "orphan", SpanID: 4, ParentID: 5})
+
+	names := func(spans []Span) []string {
+		names := []string{}
+		for _, span := range spans {
+			names = append(names, span.Name)
+		}
+		return names
+	}
+
+	chain, ok := s.GetAncestors("leaf")
+	if !ok || !slices.Equal(names(chain), []string{"leaf", "middle", "root"}) {
+		t.Fatalf("unexpected ancestors: %v", names(chain))
+	}
+
+	chain, ok = s.GetAncestors("orphan")
+	if !ok || !slices.Equal(names(chain), []string{"orphan"}) {
+		t.Fatalf("unexpected ancestors: %v", names(chain))
+	}
+
+	if _, ok := s.GetAncestors("missing"); ok {
+		t.Fatal("expected missing span not to be found")
+	}
+}
+
+func TestGetTrace(t *testing.T) {
+	t.Parallel()
+
+	root := tracer.StartSpan("test.gettrace.http")
+	child := tracer.StartSpan("test.gettrace.db", tracer.ChildOf(root.Context()))
+	grandchild := tracer.StartSpan("test.gettrace.redis", tracer.ChildOf(child.Context()))
+	grandchild.Finish()
+	child.Finish()
+	root.Finish()
+	tracer.Flush()
+
+	server.WaitForSpan(t, "test.gettrace.http")
+	traceID := FullTraceID(server.GetSpansByName("test.gettrace.http")[0])
+
+	trace := server.GetTrace(traceID)
+	if len(trace) != 3 || trace[0].Name != "test.gettrace.http" {
+		t.Fatalf("unexpected trace: %+v", trace)
+	}
+
+	tree := server.GetTraceTree(traceID)
+	if len(tree) != 1 || tree[0].Span.Name != "test.gettrace.http" {
+		t.Fatalf("unexpected roots: %+v", tree)
+	}
+	if len(tree[0].Children) != 1 || tree[0].Children[0].Span.Name != "test.gettrace.db" {
+		t.Fatalf("unexpected children: %+v", tree[0].Children)
+	}
+	db := tree[0].Children[0]
+	if len(db.Children) != 1 || db.Children[0].Span.Name != "test.gettrace.redis" || len(db.Children[0].Children) != 0 {
+		t.Fatalf("unexpected grandchildren: %+v", db.Children)
+	}
+}
+
+func TestFullTraceID(t *testing.T) {
+	if id := FullTraceID(Span{TraceID: 1}); id != "00000000000000000000000000000001" {
+		t.Fatalf("unexpected id without upper bits %q", id)
+	}
+
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{
+		{
+			{Name: "a.root", SpanID: 1, TraceID: 7, Meta: map[string]string{traceIDHighTag: "6553f2a400000000"}},
+			{Name: "a.child", SpanID: 2, TraceID: 7, ParentID: 1},
+		},
+		{
+			{Name: "b.root", SpanID: 3, TraceID: 7, Meta: map[string]string{traceIDHighTag: "6553f2a500000000"}},
+		},
+	})
+
+	fullID := FullTraceID(s.GetSpansByName("a.root")[0])
+	if fullID != "6553f2a4000000000000000000000007" {
+		t.Fatalf("unexpected full id %q", fullID)
+	}
+	trace := s.GetTrace(fullID)
+	if len(trace) != 2 || trace[0].Name != "a.root" || trace[1].Name != "a.child" {
+		t.Fatalf("unexpected full trace: %+v", trace)
+	}
+	if trace := s.GetTrace("6553F2A5000000000000000000000007"); len(trace) != 1 || trace[0].Name != "b.root" {
+		t.Fatalf("unexpected full trace: %+v", trace)
+	}
+	if trace := s.GetTrace(hexTraceID(7)); len(trace) != 0 {
+		t.Fatalf("expected the lower bits alone not to match either trace, got %+v", trace)
+	}
+}
+
+func TestWaitForSpanContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	span := tracer.StartSpan("test.waitforspancontext")
+	child := tracer.StartSpan("test.waitforspancontext.child", tracer.ChildOf(span.Context()))
+	child.Finish()
+	span.Finish()
+	tracer.Flush()
+
+	server.WaitForSpanContext(ctx, t, "test.waitforspancontext.child", "test.waitforspancontext")
+}
+
+// batchRequest builds a request sending the batch encoded in the v0.4 format.
+func batchRequest(t *testing.T, batch Batch) *http.Request {
+	t.Helper()
+
+	body, err := batch.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal batch: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, bytes.NewReader(body))
+	req.Header.Set(traceHeader, strconv.Itoa(len(batch)))
+	return req
+}
+
+// hexTraceID returns the full trace ID of a trace whose spans carry no upper trace ID bits.
+func hexTraceID(traceID uint64) string {
+	return FullTraceID(Span{TraceID: traceID})
+}
+
+// postBatch sends the batch directly to the handler of a server.
+func postBatch(t *testing.T, s *MockDatadogServer, batch Batch) *httptest.ResponseRecorder {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, batchRequest(t, batch))
+	return recorder
+}
+
+func TestResponseStatus(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging())
+
+	s.SetResponseStatus(http.StatusTooManyRequests)
+	if code := postBatch(t, s, Batch{{{Name: "rejected", SpanID: 1}}}).Code; code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if s.HasSpan("rejected") {
+		t.Fatal("expected spans in a rejected request not to be stored")
+	}
+
+	req := batchRequest(t, Batch{{{Name: "uncounted", SpanID: 2}}})
+	req.Header.Del(traceHeader)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	if len(s.DecodeErrors()) != 1 {
+		t.Fatalf("expected the trace count header to be validated, got %v", s.DecodeErrors())
+	}
+
+	s.SetResponseStatus(http.StatusOK)
+	s.SetErrorRate(1)
+	if code := postBatch(t, s, Batch{{{Name: "rejected", SpanID: 1}}}).Code; code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	s.SetErrorRate(0)
+	if code := postBatch(t, s, Batch{{{Name: "accepted", SpanID: 2}}}).Code; code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	s.ExpectSpan(t, "accepted")
+	if s.HasSpan("rejected") {
+		t.Fatal("expected spans in a rejected request not to be stored")
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	s := newMockDatadogServer()
+	s.SetResponseDelay(20 * time.Millisecond)
+
+	start := time.Now()
+	if code := postBatch(t, s, Batch{{{Name: "delayed", SpanID: 1}}}).Code; code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected response to be delayed, took %v", elapsed)
+	}
+	s.ExpectSpan(t, "delayed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := batchRequest(t, Batch{{{Name: "abandoned", SpanID: 2}}}).WithContext(ctx)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	if s.HasSpan("abandoned") {
+		t.Fatal("expected spans in an abandoned request not to be stored")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := newMockDatadogServer()
+
+	var body string
+	s.Handle("/profiling/v1/input", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	s.Handle(defaultTracePath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("expected trace path handler to be ignored")
+	}))
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/profiling/v1/input", strings.NewReader("profile")))
+	if recorder.Code != http.StatusAccepted || body != "profile" {
+		t.Fatalf("unexpected response %d with captured body %q", recorder.Code, body)
+	}
+
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/unregistered", http.NoBody))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status for unregistered path %d", recorder.Code)
+	}
+
+	postBatch(t, s, Batch{{{Name: "handled", SpanID: 1}}})
+	s.ExpectSpan(t, "handled")
+}
+
+func TestWaitWakesOnStore(t *testing.T) {
+	s := newMockDatadogServer()
+
+	req := batchRequest(t, Batch{{{Name: "wake", SpanID: 1, TraceID: 1}}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	s.WaitDurationForSpan(t, time.Second, "wake")
+	s.ExpectDurationNoSpan(t, 10*time.Millisecond, "other")
+}
+
+func TestDump(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "root", Service: "web", Resource: "GET /", SpanID: 1, TraceID: 1, Start: 1, Duration: int64(2 * time.Millisecond)})
+	s.store(Span{Name: "child", Service: "db", Resource: "SELECT", SpanID: 2, TraceID: 1, ParentID: 1, Start: 2, Duration: int64(time.Millisecond), Error: 1})
+	s.store(Span{Name: "other", Service: "web", Resource: "GET /other", SpanID: 3, TraceID: 2, Start: 3})
+
+	expected := `trace 1
+  root (service="web", resource="GET /", duration=2ms)
+    child (service="db", resource="SELECT", duration=1ms, error)
+trace 2
+  other (service="web", resource="GET /other", duration=0s)
+`
+	if actual := s.Dump(); actual != expected {
+		t.Fatalf("unexpected dump:\n%s", actual)
+	}
+}
+
+func TestTraceDOT(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "root", Service: "web", SpanID: 1, TraceID: 1, Start: 1, Duration: int64(2 * time.Millisecond)})
+	s.store(Span{Name: "child", Service: "db", SpanID: 2, TraceID: 1, ParentID: 1, Start: 2, Duration: int64(time.Millisecond), Error: 1})
+	s.store(Span{Name: "other", Service: "web", SpanID: 3, TraceID: 2, Start: 3})
+
+	expected := `digraph "trace 00000000000000000000000000000001" {
+	node [shape=box];
+	"1" [label="root\nweb\n2ms"];
+	"1" -> "2";
+	"2" [label="child\ndb\n1ms", color=red, fontcolor=red];
+}
+`
+	if actual := s.TraceDOT(hexTraceID(1)); actual != expected {
+		t.Fatalf("unexpected graph:\n%s", actual)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging(), WithStrictTraceCount())
+
+	var callbackErr error
+	var callbackBody []byte
+	s.OnDecodeError(func(err error, body []byte) {
+		callbackErr = err
+		callbackBody = body
+	})
+
+	postBatch(t, s, Batch{{{Name: "valid", SpanID: 1}}})
+	s.ExpectNoDecodeErrors(t)
+
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, strings.NewReader("not msgpack"))
+	req.Header.Set(traceHeader, "1")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	if callbackErr == nil || string(callbackBody) != "not msgpack" {
+		t.Fatalf("unexpected callback arguments: %v, %q", callbackErr, callbackBody)
+	}
+	if err := s.CheckNoDecodeErrors(); err == nil {
+		t.Fatal("expected decode errors")
+	}
+
+	body, _ := Batch{{{Name: "mismatched", SpanID: 2}}}.MarshalMsg(nil)
+	req = httptest.NewRequest(http.MethodPost, defaultTracePath, bytes.NewReader(body))
+	req.Header.Set(traceHeader, "2")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	if errs := s.DecodeErrors(); len(errs) != 2 {
+		t.Fatalf("expected 2 decode errors, got: %v", errs)
+	}
+	s.ExpectNoSpan(t, "mismatched")
+}
+
+func TestLenientTraceCount(t *testing.T) {
+	var buf bytes.Buffer
+	s := newMockDatadogServer(WithLogger(log.New(&buf, "", 0)))
+
+	body, _ := Batch{{{Name: "first", SpanID: 1}}, {{Name: "second", SpanID: 2}}}.MarshalMsg(nil)
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, bytes.NewReader(body))
+	req.Header.Set(traceHeader, "3")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.ExpectNoDecodeErrors(t)
+	s.ExpectSpan(t, "first")
+	s.ExpectSpan(t, "second")
+	if !strings.Contains(buf.String(), "declared 3 traces but 2 were received") {
+		t.Fatalf("expected the mismatch to be logged, got: %q", buf.String())
+	}
+}
+
+func TestEmptyBatches(t *testing.T) {
+	var buf bytes.Buffer
+	s := newMockDatadogServer(WithLogger(log.New(&buf, "", 0)))
+
+	empty, _ := Batch{}.MarshalMsg(nil)
+	requests := map[string]*http.Request{
+		"empty body":           httptest.NewRequest(http.MethodPost, defaultTracePath, http.NoBody),
+		"empty body with zero": httptest.NewRequest(http.MethodPost, defaultTracePath, http.NoBody),
+		"empty batch":          httptest.NewRequest(http.MethodPost, defaultTracePath, bytes.NewReader(empty)),
+	}
+	requests["empty body with zero"].Header.Set(traceHeader, "0")
+	requests["empty batch"].Header.Set(traceHeader, "0")
+
+	for name, req := range requests {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", name, recorder.Code)
+		}
+	}
+
+	s.ExpectNoDecodeErrors(t)
+	if buf.Len() != 0 {
+		t.Fatalf("expected empty batches to be quiet, got: %q", buf.String())
+	}
+	if s.BatchCount() != 0 || s.SpanCount() != 0 {
+		t.Fatalf("expected empty batches to be ignored, got batches=%d, spans=%d", s.BatchCount(), s.SpanCount())
+	}
+}
+
+func TestCounts(t *testing.T) {
+	s := newMockDatadogServer()
+
+	postBatch(t, s, Batch{
+		{{Name: "one", SpanID: 1, TraceID: 1}, {Name: "two", SpanID: 2, TraceID: 1, ParentID: 1}},
+		{{Name: "three", SpanID: 3, TraceID: 2}},
+	})
+	postBatch(t, s, Batch{{{Name: "four", SpanID: 4, TraceID: 3}}})
+
+	if s.SpanCount() != 4 || s.TraceCount() != 3 || s.BatchCount() != 2 {
+		t.Fatalf("unexpected counts: spans=%d, traces=%d, batches=%d", s.SpanCount(), s.TraceCount(), s.BatchCount())
+	}
+	if sizes := s.BatchSizes(); !slices.Equal(sizes, []int{2, 1}) {
+		t.Fatalf("unexpected batch sizes: %v", sizes)
+	}
+
+	s.Reset()
+
+	if s.SpanCount() != 0 || s.TraceCount() != 0 || s.BatchCount() != 0 || len(s.BatchSizes()) != 0 {
+		t.Fatalf("unexpected counts after reset: spans=%d, traces=%d, batches=%d, sizes=%v", s.SpanCount(), s.TraceCount(), s.BatchCount(), s.BatchSizes())
+	}
+}
+
+func TestLastRequestHeaders(t *testing.T) {
+	s := newMockDatadogServer()
+
+	if s.LastRequestHeaders() != nil {
+		t.Fatal("expected no headers before any request")
+	}
+	if err := s.CheckHeader("Datadog-Meta-Lang", "go"); err == nil {
+		t.Fatal("expected header check to fail before any request")
+	}
+
+	req := batchRequest(t, Batch{{{Name: "headers", SpanID: 1}}})
+	req.Header.Set("Datadog-Meta-Lang", "go")
+	req.Header.Set("Datadog-Container-ID", "abc123")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.ExpectHeader(t, "datadog-meta-lang", "go")
+	s.ExpectHeader(t, "Datadog-Container-ID", "abc123")
+	if err := s.CheckHeader("Datadog-Meta-Lang", "python"); err == nil {
+		t.Fatal("expected mismatched header to fail")
+	}
+	if err := s.CheckHeader("Datadog-Meta-Tracer-Version", ""); err == nil {
+		t.Fatal("expected missing header to fail")
+	}
+
+	headers := s.LastRequestHeaders()
+	headers.Set("Datadog-Meta-Lang", "modified")
+	s.ExpectHeader(t, "Datadog-Meta-Lang", "go")
+
+	s.Reset()
+	if s.LastRequestHeaders() != nil {
+		t.Fatal("expected headers to be cleared by reset")
+	}
+}
+
+func TestLastSpanTime(t *testing.T) {
+	s := newMockDatadogServer()
+	if !s.LastSpanTime().IsZero() {
+		t.Fatalf("expected zero time before any span, got %v", s.LastSpanTime())
+	}
+
+	before := time.Now()
+	postBatch(t, s, Batch{{{Name: "timed", SpanID: 1}}})
+	first := s.LastSpanTime()
+	if first.Before(before) || first.After(time.Now()) {
+		t.Fatalf("unexpected last span time %v", first)
+	}
+
+	postBatch(t, s, Batch{{{Name: "timed", SpanID: 2}}})
+	if s.LastSpanTime().Before(first) {
+		t.Fatalf("expected last span time to advance, got %v after %v", s.LastSpanTime(), first)
+	}
+}
+
+func TestGzipBody(t *testing.T) {
+	s := newMockDatadogServer()
+
+	body, err := Batch{{{Name: "gzipped", SpanID: 1}}}.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal batch: %v", err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		t.Fatalf("failed to compress batch: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("failed to compress batch: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, &buf)
+	req.Header.Set(traceHeader, "1")
+	req.Header.Set("Content-Encoding", "gzip")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.ExpectNoDecodeErrors(t)
+	s.ExpectSpan(t, "gzipped")
+}
+
+func TestStreamBatch(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging())
+	req := batchRequest(t, Batch{{{Name: "streamed", SpanID: 1}}})
+	batch, err := s.streamBatch(req, 1)
+	if err != nil || len(batch) != 1 || batch[0][0].Name != "streamed" {
+		t.Fatalf("unexpected streamed batch %+v, %v", batch, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, defaultTracePath, strings.NewReader(""))
+	if batch, err := s.streamBatch(req, 0); err != nil || batch != nil {
+		t.Fatalf("expected an empty body to be an empty batch, got %+v, %v", batch, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, defaultTracePath, strings.NewReader("bad"))
+	if _, err := s.streamBatch(req, 1); err == nil || !strings.Contains(err.Error(), "failed to parse trace") {
+		t.Fatalf("expected a malformed body to fail, got %v", err)
+	}
+
+	var received []byte
+	s.OnDecodeError(func(err error, body []byte) {
+		received = body
+	})
+	req = httptest.NewRequest(http.MethodPost, defaultTracePath, strings.NewReader("bad"))
+	req.Header.Set(traceHeader, "1")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	if string(received) != "bad" {
+		t.Fatalf("expected the body to be buffered for decode error callbacks, got %q", received)
+	}
+}
+
+func BenchmarkReadBatch(b *testing.B) {
+	s := newMockDatadogServer(WithSilentLogging())
+	batch := benchmarkBatch(10, 10)
+	body, compressed := benchmarkBodies(b, batch)
+
+	for _, test := range []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{name: "plain", body: body},
+		{name: "gzip", body: compressed, encoding: "gzip"},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			reader := bytes.NewReader(test.body)
+			req := httptest.NewRequest(http.MethodPost, defaultTracePath, reader)
+			req.Header.Set("Content-Encoding", test.encoding)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reader.Reset(test.body)
+				if _, _, err := s.readBatch(req, len(batch), unmarshalV04); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(test.name+"/stream", func(b *testing.B) {
+			reader := bytes.NewReader(test.body)
+			req := httptest.NewRequest(http.MethodPost, defaultTracePath, reader)
+			req.Header.Set("Content-Encoding", test.encoding)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reader.Reset(test.body)
+				if _, err := s.streamBatch(req, len(batch)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIngest(b *testing.B) {
+	s := newMockDatadogServer(WithSilentLogging())
+	batch := benchmarkBatch(100, 20)
+	body, compressed := benchmarkBodies(b, batch)
+
+	for _, test := range []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{name: "plain", body: body},
+		{name: "gzip", body: compressed, encoding: "gzip"},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			reader := bytes.NewReader(test.body)
+			req := httptest.NewRequest(http.MethodPost, defaultTracePath, reader)
+			req.Header.Set(traceHeader, strconv.Itoa(len(batch)))
+			req.Header.Set("Content-Encoding", test.encoding)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s.Reset()
+				reader.Reset(test.body)
+				b.StartTimer()
+
+				recorder := httptest.NewRecorder()
+				s.ServeHTTP(recorder, req)
+				if recorder.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", recorder.Code)
+				}
+			}
+			b.StopTimer()
+			s.ExpectNoDecodeErrors(b)
+		})
+	}
+}
+
+// benchmarkBatch returns a batch of traces, each made up of a root span and its children.
+func benchmarkBatch(traces, spans int) Batch {
+	batch := make(Batch, 0, traces)
+	for i := 0; i < traces; i++ {
+		trace := make(Trace, 0, spans)
+		root := uint64(i*spans + 1)
+		for j := 0; j < spans; j++ {
+			span := Span{
+				Name:     "bench.span",
+				Service:  "bench",
+				Resource: "GET /users/:id",
+				Type:     "web",
+				Start:    int64(j),
+				Duration: 1000,
+				SpanID:   root + uint64(j),
+				TraceID:  uint64(i + 1),
+				Meta:     map[string]string{"env": "test", "http.method": "GET"},
+				Metrics:  map[string]float64{priorityMetric: 1},
+			}
+			if j > 0 {
+				span.ParentID = root
+			}
+			trace = append(trace, span)
+		}
+		batch = append(batch, trace)
+	}
+	return batch
+}
+
+// benchmarkBodies returns the batch encoded as a v0.4 request body both as is and gzip compressed.
+func benchmarkBodies(b *testing.B, batch Batch) ([]byte, []byte) {
+	b.Helper()
+
+	body, err := batch.MarshalMsg(nil)
+	if err != nil {
+		b.Fatalf("failed to marshal batch: %v", err)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(body); err != nil {
+		b.Fatalf("failed to compress batch: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		b.Fatalf("failed to compress batch: %v", err)
+	}
+	return body, compressed.Bytes()
+}
+
+func TestSubscribe(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging())
+
+	spans, unsubscribe := s.Subscribe()
+	postBatch(t, s, Batch{{{Name: "first", SpanID: 1}, {Name: "second", SpanID: 2}}})
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case span := <-spans:
+			if span.Name != expected {
+				t.Fatalf("expected span %q, got %q", expected, span.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for span %q", expected)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+	postBatch(t, s, Batch{{{Name: "third", SpanID: 3}}})
+
+	if _, ok := <-spans; ok {
+		t.Fatal("expected channel to be closed after unsubscribing")
+	}
+}
+
+func TestSubscribeSlowConsumer(t *testing.T) {
+	var buf bytes.Buffer
+	s := newMockDatadogServer(WithLogger(log.New(&buf, "", 0)))
+
+	spans, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	batch := Batch{make(Trace, subscriptionBuffer+10)}
+	for i := range batch[0] {
+		batch[0][i] = Span{Name: "slow", SpanID: uint64(i + 1)}
+	}
+	postBatch(t, s, batch)
+
+	if len(spans) != subscriptionBuffer {
+		t.Fatalf("expected a full buffer of %d spans, got %d", subscriptionBuffer, len(spans))
+	}
+	s.ExpectSpanCount(t, "slow", subscriptionBuffer+10)
+	if logged := buf.String(); logged != "subscriber is not keeping up, dropped 10 spans\n" {
+		t.Fatalf("expected the drops to be logged once for the batch, got %q", logged)
+	}
+}
+
+func TestOnSpan(t *testing.T) {
+	s := newMockDatadogServer()
+
+	calls := []string{}
+	s.OnSpan(func(span Span) {
+		calls = append(calls, "first:"+span.Name)
+		// callbacks run outside of the lock so they may use the server
+		s.ExpectSpan(t, span.Name)
+	})
+	s.OnSpan(func(span Span) {
+		calls = append(calls, "second:"+span.Name)
+	})
+
+	postBatch(t, s, Batch{{{Name: "a", SpanID: 1}, {Name: "b", SpanID: 2}}})
+
+	expected := []string{"first:a", "second:a", "first:b", "second:b"}
+	if !slices.Equal(calls, expected) {
+		t.Fatalf("unexpected callback order: %v", calls)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "second", SpanID: 2, Start: 2, Meta: map[string]string{"key": "value"}})
+	s.store(Span{Name: "first", SpanID: 1, Start: 1, Metrics: map[string]float64{"key": 1}})
+
+	snapshot := s.Snapshot()
+	if len(snapshot) != 2 || snapshot[0].Name != "first" || snapshot[1].Name != "second" {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+
+	snapshot[0].Metrics["key"] = 2
+	snapshot[1].Meta["key"] = "changed"
+
+	s.ExpectSpanMetric(t, "first", "key", 1, 0)
+	s.ExpectSpanMeta(t, "second", map[string]string{"key": "value"})
+}
+
+func TestGetSpansMatching(t *testing.T) {
+	t.Parallel()
+
+	root := tracer.StartSpan("test.getspansmatching.grpc.server")
+	tracer.StartSpan("test.getspansmatching.grpc.client", tracer.ChildOf(root.Context())).Finish()
+	tracer.StartSpan("test.getspansmatching.http.client", tracer.ChildOf(root.Context())).Finish()
+	root.Finish()
+	tracer.Flush()
+
+	server.WaitForSpanMatching(t, regexp.MustCompile(`^test\.getspansmatching\.grpc\.`))
+
+	spans := server.GetSpansMatching(regexp.MustCompile(`^test\.getspansmatching\.grpc\.`))
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 matching spans, got: %+v", spans)
+	}
+}
+
+func TestGetChildren(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "parent", SpanID: 1})
+	s.store(Span{Name: "second", SpanID: 3, ParentID: 1, Start: 2})
+	s.store(Span{Name: "first", SpanID: 2, ParentID: 1, Start: 1})
+	s.store(Span{Name: "grandchild", SpanID: 4, ParentID: 2, Start: 3})
+
+	children := s.GetChildren(1)
+	if len(children) != 2 || children[0].Name != "first" || children[1].Name != "second" {
+		t.Fatalf("unexpected children: %+v", children)
+	}
+
+	children = s.GetChildrenByName("first")
+	if len(children) != 1 || children[0].Name != "grandchild" {
+		t.Fatalf("unexpected children: %+v", children)
+	}
+
+	if children := s.GetChildren(4); len(children) != 0 {
+		t.Fatalf("unexpected children: %+v", children)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging())
+	batch := Batch{{{Name: "a", SpanID: 1, TraceID: 1}, {Name: "b", SpanID: 2, TraceID: 1}}, {{Name: "c", SpanID: 3, TraceID: 2}}}
+	body, err := batch.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal batch: %v", err)
+	}
+	postBatch(t, s, batch)
+
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, strings.NewReader("bad"))
+	req.Header.Set(traceHeader, "1")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := ServerMetrics{Spans: 3, Traces: 2, Batches: 1, DecodeErrors: 1, BytesReceived: int64(len(body) + len("bad"))}
+	if metrics := s.Metrics(); metrics != expected {
+		t.Fatalf("expected metrics %+v, got %+v", expected, metrics)
+	}
+
+	s.Reset()
+	if metrics := s.Metrics(); metrics != (ServerMetrics{}) {
+		t.Fatalf("expected reset to clear metrics, got %+v", metrics)
+	}
+}
+
+func TestSpanAccessors(t *testing.T) {
+	span := Span{
+		Meta:    map[string]string{"http.status_code": "404", "http.method": "GET"},
+		Metrics: map[string]float64{"rows": 5},
+		Error:   1,
+	}
+
+	if value, ok := span.Tag("http.method"); !ok || value != "GET" {
+		t.Fatalf("unexpected tag %q, %t", value, ok)
+	}
+	if _, ok := span.Tag("missing"); ok {
+		t.Fatal("expected missing tag")
+	}
+	if value, ok := span.IntTag("http.status_code"); !ok || value != 404 {
+		t.Fatalf("unexpected int tag %d, %t", value, ok)
+	}
+	if _, ok := span.IntTag("http.method"); ok {
+		t.Fatal("expected unparseable int tag")
+	}
+	if _, ok := span.IntTag("missing"); ok {
+		t.Fatal("expected missing int tag")
+	}
+	if value, ok := span.Metric("rows"); !ok || value != 5 {
+		t.Fatalf("unexpected metric %v, %t", value, ok)
+	}
+	if _, ok := span.Metric("missing"); ok {
+		t.Fatal("expected missing metric")
+	}
+	if !span.HasError() || (Span{}).HasError() {
+		t.Fatal("unexpected error flag")
+	}
+}
@@ -0,0 +1,193 @@
+package doghouse
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// unmarshalV03 decodes a batch sent to the legacy v0.3 endpoint. The payload has the same shape as v0.4, an array
+// of traces that are each an array of span maps, but older tracers encode numbers with whichever msgpack type fits,
+// including signed integers and floats for IDs, and send nil for unset fields, so every field is decoded leniently.
+func unmarshalV03(b []byte) (Batch, error) {
+	sz, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	batch := make(Batch, sz)
+	for i := range batch {
+		sz, b, err = msgp.ReadArrayHeaderBytes(b)
+		if err != nil {
+			return nil, msgp.WrapError(err, i)
+		}
+		batch[i] = make(Trace, sz)
+		for j := range batch[i] {
+			batch[i][j], b, err = v03Span(b)
+			if err != nil {
+				return nil, msgp.WrapError(err, i, j)
+			}
+		}
+	}
+	return batch, nil
+}
+
+// unmarshalV03JSON decodes a batch sent to the legacy v0.3 endpoint as JSON, which uses the same keys as msgpack.
+func unmarshalV03JSON(b []byte) (Batch, error) {
+	var batch Batch
+	err := json.Unmarshal(b, &batch)
+	return batch, err
+}
+
+// v03Span reads a single v0.3 encoded span, skipping any keys it does not know.
+func v03Span(b []byte) (span Span, _ []byte, err error) {
+	sz, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return span, b, err
+	}
+	for ; sz > 0; sz-- {
+		var key []byte
+		key, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return span, b, err
+		}
+		switch string(key) {
+		case "name":
+			span.Name, b, err = v03String(b)
+		case "service":
+			span.Service, b, err = v03String(b)
+		case "resource":
+			span.Resource, b, err = v03String(b)
+		case "type":
+			span.Type, b, err = v03String(b)
+		case "start":
+			span.Start, b, err = v03Int64(b)
+		case "duration":
+			span.Duration, b, err = v03Int64(b)
+		case "meta":
+			span.Meta, b, err = v03Meta(b)
+		case "metrics":
+			span.Metrics, b, err = v03Metrics(b)
+		case "span_id":
+			span.SpanID, b, err = v03Uint64(b)
+		case "trace_id":
+			span.TraceID, b, err = v03Uint64(b)
+		case "parent_id":
+			span.ParentID, b, err = v03Uint64(b)
+		case "error":
+			var code int64
+			code, b, err = v03Int64(b)
+			span.Error = int32(code)
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return span, b, msgp.WrapError(err, string(key))
+		}
+	}
+	return span, b, nil
+}
+
+// v03String reads a string that may also be encoded as binary or nil.
+func v03String(b []byte) (string, []byte, error) {
+	switch msgp.NextType(b) {
+	case msgp.NilType:
+		b, err := msgp.ReadNilBytes(b)
+		return "", b, err
+	case msgp.BinType:
+		v, b, err := msgp.ReadBytesZC(b)
+		return string(v), b, err
+	}
+	return msgp.ReadStringBytes(b)
+}
+
+// v03Uint64 reads a number encoded as any msgpack integer or float type, or nil for zero. Negative integers are
+// reinterpreted as unsigned since some tracers encode IDs as signed 64-bit integers.
+func v03Uint64(b []byte) (uint64, []byte, error) {
+	switch msgp.NextType(b) {
+	case msgp.UintType:
+		return msgp.ReadUint64Bytes(b)
+	case msgp.IntType:
+		i, b, err := msgp.ReadInt64Bytes(b)
+		return uint64(i), b, err
+	case msgp.Float64Type, msgp.Float32Type:
+		f, b, err := msgp.ReadFloat64Bytes(b)
+		return uint64(f), b, err
+	case msgp.NilType:
+		b, err := msgp.ReadNilBytes(b)
+		return 0, b, err
+	}
+	return 0, b, fmt.Errorf("expected a number, got %s", msgp.NextType(b))
+}
+
+// v03Int64 reads a signed number encoded as any msgpack integer or float type, or nil for zero.
+func v03Int64(b []byte) (int64, []byte, error) {
+	if t := msgp.NextType(b); t == msgp.Float64Type || t == msgp.Float32Type {
+		f, b, err := msgp.ReadFloat64Bytes(b)
+		return int64(f), b, err
+	}
+	u, b, err := v03Uint64(b)
+	return int64(u), b, err
+}
+
+// v03Float64 reads a float that may also be encoded as an integer.
+func v03Float64(b []byte) (float64, []byte, error) {
+	switch msgp.NextType(b) {
+	case msgp.UintType:
+		u, b, err := msgp.ReadUint64Bytes(b)
+		return float64(u), b, err
+	case msgp.IntType:
+		i, b, err := msgp.ReadInt64Bytes(b)
+		return float64(i), b, err
+	}
+	return msgp.ReadFloat64Bytes(b)
+}
+
+// v03Meta reads the meta map, which may be nil.
+func v03Meta(b []byte) (map[string]string, []byte, error) {
+	if msgp.IsNil(b) {
+		b, err := msgp.ReadNilBytes(b)
+		return nil, b, err
+	}
+	sz, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return nil, b, err
+	}
+	meta := make(map[string]string, sz)
+	for ; sz > 0; sz-- {
+		var key, value string
+		if key, b, err = v03String(b); err != nil {
+			return nil, b, err
+		}
+		if value, b, err = v03String(b); err != nil {
+			return nil, b, msgp.WrapError(err, key)
+		}
+		meta[key] = value
+	}
+	return meta, b, nil
+}
+
+// v03Metrics reads the metrics map, which may be nil.
+func v03Metrics(b []byte) (map[string]float64, []byte, error) {
+	if msgp.IsNil(b) {
+		b, err := msgp.ReadNilBytes(b)
+		return nil, b, err
+	}
+	sz, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return nil, b, err
+	}
+	metrics := make(map[string]float64, sz)
+	for ; sz > 0; sz-- {
+		var key string
+		var value float64
+		if key, b, err = v03String(b); err != nil {
+			return nil, b, err
+		}
+		if value, b, err = v03Float64(b); err != nil {
+			return nil, b, msgp.WrapError(err, key)
+		}
+		metrics[key] = value
+	}
+	return metrics, b, nil
+}
@@ -0,0 +1,117 @@
+package doghouse
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// v03Payload is a single trace encoded the way older tracers post to /v0.3/traces: IDs as signed integers, the
+// duration as a float, nil for unset fields, binary meta values, integer metrics, and an unknown key.
+func v03Payload() []byte {
+	var b []byte
+	b = msgp.AppendArrayHeader(b, 1)
+	b = msgp.AppendArrayHeader(b, 2)
+
+	b = msgp.AppendMapHeader(b, 12)
+	b = msgp.AppendString(b, "trace_id")
+	b = msgp.AppendInt64(b, -1)
+	b = msgp.AppendString(b, "span_id")
+	b = msgp.AppendInt64(b, 1)
+	b = msgp.AppendString(b, "parent_id")
+	b = msgp.AppendNil(b)
+	b = msgp.AppendString(b, "name")
+	b = msgp.AppendString(b, "v03.parent")
+	b = msgp.AppendString(b, "service")
+	b = msgp.AppendString(b, "legacy")
+	b = msgp.AppendString(b, "resource")
+	b = msgp.AppendString(b, "GET /")
+	b = msgp.AppendString(b, "type")
+	b = msgp.AppendNil(b)
+	b = msgp.AppendString(b, "start")
+	b = msgp.AppendInt64(b, 1500000000000000000)
+	b = msgp.AppendString(b, "duration")
+	b = msgp.AppendFloat64(b, 2500)
+	b = msgp.AppendString(b, "error")
+	b = msgp.AppendInt(b, 1)
+	b = msgp.AppendString(b, "meta")
+	b = msgp.AppendMapHeader(b, 1)
+	b = msgp.AppendString(b, "env")
+	b = msgp.AppendBytes(b, []byte("test"))
+	b = msgp.AppendString(b, "sampling")
+	b = msgp.AppendString(b, "ignored")
+
+	b = msgp.AppendMapHeader(b, 6)
+	b = msgp.AppendString(b, "trace_id")
+	b = msgp.AppendInt64(b, -1)
+	b = msgp.AppendString(b, "span_id")
+	b = msgp.AppendUint32(b, 2)
+	b = msgp.AppendString(b, "parent_id")
+	b = msgp.AppendInt8(b, 1)
+	b = msgp.AppendString(b, "name")
+	b = msgp.AppendString(b, "v03.child")
+	b = msgp.AppendString(b, "meta")
+	b = msgp.AppendNil(b)
+	b = msgp.AppendString(b, "metrics")
+	b = msgp.AppendMapHeader(b, 2)
+	b = msgp.AppendString(b, "rows")
+	b = msgp.AppendInt(b, 3)
+	b = msgp.AppendString(b, "ratio")
+	b = msgp.AppendFloat32(b, 0.5)
+	return b
+}
+
+func TestV03Traces(t *testing.T) {
+	s := newMockDatadogServer()
+
+	req := httptest.NewRequest(http.MethodPost, v03TracePath, bytes.NewReader(v03Payload()))
+	req.Header.Set(traceHeader, "1")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.ExpectNoDecodeErrors(t)
+	s.ExpectSpan(t, "v03.child", "v03.parent")
+	s.ExpectSpanMeta(t, "v03.parent", map[string]string{"env": "test"})
+	s.ExpectSpanMetric(t, "v03.child", "rows", 3, 0)
+	s.ExpectSpanMetric(t, "v03.child", "ratio", 0.5, 0)
+	s.ExpectSpanFn(t, "v03.parent", func(span Span) bool {
+		return span.TraceID == math.MaxUint64 && span.Duration == 2500 && span.Start == 1500000000000000000 &&
+			span.Error == 1 && span.Service == "legacy" && span.Resource == "GET /" && span.Type == ""
+	}, "v0.3 span fields did not decode")
+	if trace := s.GetTrace(hexTraceID(math.MaxUint64)); len(trace) != 2 {
+		t.Fatalf("expected both spans in the trace, got %+v", trace)
+	}
+}
+
+func TestV03JSONTraces(t *testing.T) {
+	s := newMockDatadogServer()
+
+	body := `[[{"name":"v03.json","service":"legacy","span_id":1,"trace_id":18446744073709551615,"start":1,"duration":2,"meta":{"env":"test"}}]]`
+	req := httptest.NewRequest(http.MethodPost, v03TracePath, strings.NewReader(body))
+	req.Header.Set(traceHeader, "1")
+	req.Header.Set("Content-Type", "application/json")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.ExpectNoDecodeErrors(t)
+	s.ExpectSpanMeta(t, "v03.json", map[string]string{"env": "test"})
+	if trace := s.GetTrace(hexTraceID(math.MaxUint64)); len(trace) != 1 {
+		t.Fatalf("unexpected trace: %+v", trace)
+	}
+}
+
+func TestV03InvalidNumber(t *testing.T) {
+	var b []byte
+	b = msgp.AppendArrayHeader(b, 1)
+	b = msgp.AppendArrayHeader(b, 1)
+	b = msgp.AppendMapHeader(b, 1)
+	b = msgp.AppendString(b, "span_id")
+	b = msgp.AppendString(b, "1")
+
+	if _, err := unmarshalV03(b); err == nil || !strings.Contains(err.Error(), "span_id") {
+		t.Fatalf("expected an error for a string span id, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package doghouse
+
+import (
+	"fmt"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// v05SpanFields is the number of array elements in a v0.5 encoded span.
+const v05SpanFields = 12
+
+// unmarshalV05 decodes a batch encoded in the v0.5 format. The payload is a two element array consisting of a
+// string table followed by the traces, where every string in a span is encoded as an index into the table:
+//
+//	[[string...], [[[service, name, resource, trace_id, span_id, parent_id, start, duration, error, meta, metrics, type]...]...]]
+func unmarshalV05(b []byte) (Batch, error) {
+	sz, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if sz != 2 {
+		return nil, fmt.Errorf("expected v0.5 payload with 2 elements, got %d", sz)
+	}
+
+	sz, b, err = msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return nil, msgp.WrapError(err, "strings")
+	}
+	table := make([]string, sz)
+	for i := range table {
+		table[i], b, err = msgp.ReadStringBytes(b)
+		if err != nil {
+			return nil, msgp.WrapError(err, "strings", i)
+		}
+	}
+	d := &v05Decoder{table: table}
+
+	sz, b, err = msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return nil, msgp.WrapError(err, "traces")
+	}
+	batch := make(Batch, sz)
+	for i := range batch {
+		sz, b, err = msgp.ReadArrayHeaderBytes(b)
+		if err != nil {
+			return nil, msgp.WrapError(err, "traces", i)
+		}
+		batch[i] = make(Trace, sz)
+		for j := range batch[i] {
+			batch[i][j], b, err = d.span(b)
+			if err != nil {
+				return nil, msgp.WrapError(err, "traces", i, j)
+			}
+		}
+	}
+	return batch, nil
+}
+
+// v05Decoder decodes v0.5 spans by dereferencing string indices against a string table.
+type v05Decoder struct {
+	table []string
+}
+
+// readString reads a string table index and returns the string it refers to.
+func (d *v05Decoder) readString(b []byte) (string, []byte, error) {
+	i, b, err := msgp.ReadUint32Bytes(b)
+	if err != nil {
+		return "", b, err
+	}
+	if int(i) >= len(d.table) {
+		return "", b, fmt.Errorf("string index %d out of range for table of size %d", i, len(d.table))
+	}
+	return d.table[i], b, nil
+}
+
+// span reads a single v0.5 encoded span.
+func (d *v05Decoder) span(b []byte) (span Span, _ []byte, err error) {
+	sz, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return span, b, err
+	}
+	if sz != v05SpanFields {
+		return span, b, fmt.Errorf("expected v0.5 span with %d elements, got %d", v05SpanFields, sz)
+	}
+
+	if span.Service, b, err = d.readString(b); err != nil {
+		return span, b, msgp.WrapError(err, "service")
+	}
+	if span.Name, b, err = d.readString(b); err != nil {
+		return span, b, msgp.WrapError(err, "name")
+	}
+	if span.Resource, b, err = d.readString(b); err != nil {
+		return span, b, msgp.WrapError(err, "resource")
+	}
+	if span.TraceID, b, err = msgp.ReadUint64Bytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "trace_id")
+	}
+	if span.SpanID, b, err = msgp.ReadUint64Bytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "span_id")
+	}
+	if span.ParentID, b, err = msgp.ReadUint64Bytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "parent_id")
+	}
+	if span.Start, b, err = msgp.ReadInt64Bytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "start")
+	}
+	if span.Duration, b, err = msgp.ReadInt64Bytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "duration")
+	}
+	if span.Error, b, err = msgp.ReadInt32Bytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "error")
+	}
+
+	if sz, b, err = msgp.ReadMapHeaderBytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "meta")
+	}
+	if sz > 0 {
+		span.Meta = make(map[string]string, sz)
+	}
+	for i := uint32(0); i < sz; i++ {
+		var key, value string
+		if key, b, err = d.readString(b); err != nil {
+			return span, b, msgp.WrapError(err, "meta")
+		}
+		if value, b, err = d.readString(b); err != nil {
+			return span, b, msgp.WrapError(err, "meta", key)
+		}
+		span.Meta[key] = value
+	}
+
+	if sz, b, err = msgp.ReadMapHeaderBytes(b); err != nil {
+		return span, b, msgp.WrapError(err, "metrics")
+	}
+	if sz > 0 {
+		span.Metrics = make(map[string]float64, sz)
+	}
+	for i := uint32(0); i < sz; i++ {
+		var key string
+		var value float64
+		if key, b, err = d.readString(b); err != nil {
+			return span, b, msgp.WrapError(err, "metrics")
+		}
+		if value, b, err = msgp.ReadFloat64Bytes(b); err != nil {
+			return span, b, msgp.WrapError(err, "metrics", key)
+		}
+		span.Metrics[key] = value
+	}
+
+	if span.Type, b, err = d.readString(b); err != nil {
+		return span, b, msgp.WrapError(err, "type")
+	}
+	return span, b, nil
+}
@@ -0,0 +1,99 @@
+package doghouse
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// marshalV05 encodes a batch in the v0.5 format for testing the decoder.
+func marshalV05(batch Batch) []byte {
+	table := []string{}
+	indices := map[string]uint32{}
+	index := func(s string) uint32 {
+		if i, ok := indices[s]; ok {
+			return i
+		}
+		i := uint32(len(table))
+		table = append(table, s)
+		indices[s] = i
+		return i
+	}
+
+	var traces []byte
+	traces = msgp.AppendArrayHeader(traces, uint32(len(batch)))
+	for _, trace := range batch {
+		traces = msgp.AppendArrayHeader(traces, uint32(len(trace)))
+		for _, span := range trace {
+			traces = msgp.AppendArrayHeader(traces, v05SpanFields)
+			traces = msgp.AppendUint32(traces, index(span.Service))
+			traces = msgp.AppendUint32(traces, index(span.Name))
+			traces = msgp.AppendUint32(traces, index(span.Resource))
+			traces = msgp.AppendUint64(traces, span.TraceID)
+			traces = msgp.AppendUint64(traces, span.SpanID)
+			traces = msgp.AppendUint64(traces, span.ParentID)
+			traces = msgp.AppendInt64(traces, span.Start)
+			traces = msgp.AppendInt64(traces, span.Duration)
+			traces = msgp.AppendInt32(traces, span.Error)
+			traces = msgp.AppendMapHeader(traces, uint32(len(span.Meta)))
+			for k, v := range span.Meta {
+				traces = msgp.AppendUint32(traces, index(k))
+				traces = msgp.AppendUint32(traces, index(v))
+			}
+			traces = msgp.AppendMapHeader(traces, uint32(len(span.Metrics)))
+			for k, v := range span.Metrics {
+				traces = msgp.AppendUint32(traces, index(k))
+				traces = msgp.AppendFloat64(traces, v)
+			}
+			traces = msgp.AppendUint32(traces, index(span.Type))
+		}
+	}
+
+	var b []byte
+	b = msgp.AppendArrayHeader(b, 2)
+	b = msgp.AppendArrayHeader(b, uint32(len(table)))
+	for _, s := range table {
+		b = msgp.AppendString(b, s)
+	}
+	return append(b, traces...)
+}
+
+func TestV05Traces(t *testing.T) {
+	s := newMockDatadogServer()
+
+	batch := Batch{
+		{
+			{Name: "v05.parent", Service: "svc", Resource: "GET /", Type: "web", SpanID: 1, TraceID: 1, Meta: map[string]string{"env": "test"}},
+			{Name: "v05.child", Service: "svc", Resource: "query", Type: "sql", SpanID: 2, TraceID: 1, ParentID: 1, Metrics: map[string]float64{"rows": 3}},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, v05TracePath, bytes.NewReader(marshalV05(batch)))
+	req.Header.Set(traceHeader, strconv.Itoa(len(batch)))
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.ExpectSpan(t, "v05.child", "v05.parent")
+	s.ExpectSpanMeta(t, "v05.parent", map[string]string{"env": "test"})
+	s.ExpectSpanMetric(t, "v05.child", "rows", 3, 0)
+	s.ExpectSpanFn(t, "v05.child", func(span Span) bool {
+		return span.Resource == "query" && span.Type == "sql" && span.Service == "svc"
+	}, "v0.5 span fields did not decode")
+}
+
+func TestV05InvalidStringIndex(t *testing.T) {
+	var b []byte
+	b = msgp.AppendArrayHeader(b, 2)
+	b = msgp.AppendArrayHeader(b, 0)
+	b = msgp.AppendArrayHeader(b, 1)
+	b = msgp.AppendArrayHeader(b, 1)
+	b = msgp.AppendArrayHeader(b, v05SpanFields)
+	b = msgp.AppendUint32(b, 5)
+
+	if _, err := unmarshalV05(b); err == nil {
+		t.Fatal("expected an error for an out of range string index")
+	}
+}
@@ -0,0 +1,75 @@
+package doghouse
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const forwardTimeout = 5 * time.Second
+
+// WithForward makes the server forward every trace payload it decodes to the agent at the given url, such as
+// http://localhost:8126, so that traces collected for assertions can also be inspected in Datadog. The original
+// body and headers are sent to the same path in the background once the spans have been stored, so a slow or
+// unreachable agent never delays the response sent to the tracer, and Close waits for pending forwards to finish.
+// Forwarding failures are logged and do not affect the response.
+func WithForward(url string) Option {
+	return func(s *MockDatadogServer) {
+		s.forwardURL = strings.TrimSuffix(url, "/")
+		s.forwardClient = &http.Client{Timeout: forwardTimeout}
+	}
+}
+
+// bufferBody reads the request body so that it can be recorded and forwarded once it has been decoded, replacing
+// the body with a reader over the same bytes. It returns nil without reading when neither is enabled.
+func (s *MockDatadogServer) bufferBody(r *http.Request) ([]byte, error) {
+	if s.forwardURL == "" && s.recordLimit < 1 {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// forward sends the original request body and headers to the upstream agent from a goroutine tracked by
+// s.forwards, logging any failure. The request is built before returning since r must not be used once the handler
+// has responded.
+func (s *MockDatadogServer) forward(r *http.Request, body []byte) {
+	if s.forwardURL == "" {
+		return
+	}
+	url := s.forwardURL + r.URL.RequestURI()
+	req, err := http.NewRequest(r.Method, url, bytes.NewReader(body))
+	if err != nil {
+		s.logger.Printf("failed to forward request to %s: %v", url, err)
+		return
+	}
+	req.Header = r.Header.Clone()
+
+	s.forwards.Add(1)
+	go func() {
+		defer s.forwards.Done()
+		s.sendForward(req)
+	}()
+}
+
+// sendForward performs a forwarded request, draining the response so the connection can be reused.
+func (s *MockDatadogServer) sendForward(req *http.Request) {
+	url := req.URL.String()
+	resp, err := s.forwardClient.Do(req)
+	if err != nil {
+		s.logger.Printf("failed to forward request to %s: %v", url, err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		s.logger.Printf("forwarded request to %s was rejected with status %d", url, resp.StatusCode)
+	}
+}
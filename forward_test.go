@@ -0,0 +1,83 @@
+package doghouse
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithForward(t *testing.T) {
+	var received []byte
+	var headers http.Header
+	var path string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		headers = r.Header
+		path = r.URL.Path
+	}))
+	defer upstream.Close()
+
+	s := newMockDatadogServer(WithForward(upstream.URL + "/"))
+	batch := Batch{{{Name: "forwarded", SpanID: 1, TraceID: 1}}}
+	body, err := batch.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal batch: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, bytes.NewReader(body))
+	req.Header.Set(traceHeader, "1")
+	req.Header.Set("Datadog-Meta-Lang", "go")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	s.Close()
+
+	s.ExpectSpan(t, "forwarded")
+	if !bytes.Equal(received, body) {
+		t.Fatalf("expected the original body to be forwarded, got %q", received)
+	}
+	if path != defaultTracePath || headers.Get(traceHeader) != "1" || headers.Get("Datadog-Meta-Lang") != "go" {
+		t.Fatalf("expected the request to be forwarded to %s with its headers, got %s %v", defaultTracePath, path, headers)
+	}
+}
+
+func TestWithForwardError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Close()
+
+	var buf bytes.Buffer
+	s := newMockDatadogServer(WithForward(upstream.URL), WithLogger(log.New(&buf, "", 0)))
+
+	if code := postBatch(t, s, Batch{{{Name: "stored", SpanID: 1}}}).Code; code != http.StatusOK {
+		t.Fatalf("expected forwarding failures not to affect the response, got %d", code)
+	}
+	s.Close()
+	s.ExpectSpan(t, "stored")
+	if !strings.Contains(buf.String(), "failed to forward request") {
+		t.Fatalf("expected forwarding failure to be logged, got: %q", buf.String())
+	}
+}
+
+func TestWithForwardStalledUpstream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+
+	s := newMockDatadogServer(WithForward(upstream.URL), WithSilentLogging())
+
+	start := time.Now()
+	if code := postBatch(t, s, Batch{{{Name: "stored", SpanID: 1}}}).Code; code != http.StatusOK {
+		t.Fatalf("expected the tracer to be answered while the upstream is stalled, got %d", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the response not to wait on the stalled upstream, took %v", elapsed)
+	}
+	s.ExpectSpan(t, "stored")
+
+	close(release)
+	s.Close()
+}
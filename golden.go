@@ -0,0 +1,218 @@
+package doghouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// defaultGoldenIgnoreFields are the Span fields that change between runs and are ignored when comparing against
+// a golden file unless overridden with WithGoldenIgnoreFields.
+var defaultGoldenIgnoreFields = []string{
+	"Start", "Duration", "SpanID", "TraceID", "ParentID", "Links.TraceID", "Links.TraceIDHigh", "Links.SpanID",
+}
+
+// ExpectMatchesGolden ensures that the received spans match the spans in the golden JSON file at path, as written
+// by SaveJSON, ignoring the fields configured with WithGoldenIgnoreFields.
+func (s *MockDatadogServer) ExpectMatchesGolden(t testing.TB, path string) {
+	t.Helper()
+
+	if err := s.CheckMatchesGolden(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckMatchesGolden returns an error unless the received spans match the spans in the golden JSON file at path.
+// Spans are matched regardless of order and the error lists the differing fields of each mismatched span.
+func (s *MockDatadogServer) CheckMatchesGolden(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open golden file: %w", err)
+	}
+	defer f.Close()
+
+	var golden []Span
+	if err := json.NewDecoder(f).Decode(&golden); err != nil {
+		return fmt.Errorf("failed to decode golden file %s: %w", path, err)
+	}
+
+	for i, span := range golden {
+		if golden[i], err = normalizeGolden(span, s.goldenIgnoreFields); err != nil {
+			return err
+		}
+	}
+	actual := s.Snapshot()
+	for i, span := range actual {
+		if actual[i], err = normalizeGolden(span, s.goldenIgnoreFields); err != nil {
+			return err
+		}
+	}
+
+	if diff := diffGolden(golden, actual); diff != "" {
+		return fmt.Errorf("received spans do not match golden file %s:\n%s", path, diff)
+	}
+	return nil
+}
+
+// DiffSpans describes the field level differences between two sets of spans, such as those returned by Snapshot
+// for the same operation run under two configurations, or returns an empty string if they match. Spans are matched
+// regardless of order and the fields that change between runs, Start, Duration, SpanID, TraceID, ParentID, and the
+// IDs of span links, are ignored. Spans only in a are reported as missing and spans only in b as unexpected.
+func DiffSpans(a, b []Span) string {
+	normalize := func(spans []Span) []Span {
+		normalized := make([]Span, 0, len(spans))
+		for _, span := range spans {
+			// the default fields always exist so normalizing cannot fail
+			span, _ = normalizeGolden(span, defaultGoldenIgnoreFields)
+			normalized = append(normalized, span)
+		}
+		return normalized
+	}
+	return diffGolden(normalize(a), normalize(b))
+}
+
+// normalizeGolden zeroes the ignored fields of the span. A field of the form Meta.<key> or Metrics.<key> removes
+// a single tag, Links.<field> zeroes that field of every span link, and empty maps are normalized to nil since
+// SaveJSON omits them.
+func normalizeGolden(span Span, ignore []string) (Span, error) {
+	span = copySpan(span)
+	value := reflect.ValueOf(&span).Elem()
+	for _, field := range ignore {
+		if key, ok := strings.CutPrefix(field, "Meta."); ok {
+			delete(span.Meta, key)
+			continue
+		}
+		if key, ok := strings.CutPrefix(field, "Metrics."); ok {
+			delete(span.Metrics, key)
+			continue
+		}
+		if key, ok := strings.CutPrefix(field, "Links."); ok {
+			if !reflect.ValueOf(SpanLink{}).FieldByName(key).IsValid() {
+				return Span{}, fmt.Errorf("unknown golden ignore field %q", field)
+			}
+			for i := range span.Links {
+				reflect.ValueOf(&span.Links[i]).Elem().FieldByName(key).SetZero()
+			}
+			continue
+		}
+		f := value.FieldByName(field)
+		if !f.IsValid() {
+			return Span{}, fmt.Errorf("unknown golden ignore field %q", field)
+		}
+		f.SetZero()
+	}
+	if len(span.Meta) == 0 {
+		span.Meta = nil
+	}
+	if len(span.Metrics) == 0 {
+		span.Metrics = nil
+	}
+	return span, nil
+}
+
+// diffGolden describes the differences between the expected and actual spans or returns an empty string if every
+// span has an identical counterpart. Unmatched spans with the same name are compared field by field.
+func diffGolden(expected, actual []Span) string {
+	unmatched := append([]Span(nil), actual...)
+	missing := []Span{}
+	for _, span := range expected {
+		i := indexOfSpan(unmatched, func(candidate Span) bool {
+			return reflect.DeepEqual(candidate, span)
+		})
+		if i < 0 {
+			missing = append(missing, span)
+			continue
+		}
+		unmatched = append(unmatched[:i], unmatched[i+1:]...)
+	}
+
+	var b strings.Builder
+	for _, span := range missing {
+		i := indexOfSpan(unmatched, func(candidate Span) bool {
+			return candidate.Name == span.Name
+		})
+		if i < 0 {
+			fmt.Fprintf(&b, "  missing span %q\n", span.Name)
+			continue
+		}
+		fmt.Fprintf(&b, "  span %q:\n", span.Name)
+		for _, difference := range diffFields(span, unmatched[i]) {
+			fmt.Fprintf(&b, "    %s\n", difference)
+		}
+		unmatched = append(unmatched[:i], unmatched[i+1:]...)
+	}
+	for _, span := range unmatched {
+		fmt.Fprintf(&b, "  unexpected span %q\n", span.Name)
+	}
+	return b.String()
+}
+
+// indexOfSpan returns the index of the first span that matches or -1 if none do.
+func indexOfSpan(spans []Span, match func(span Span) bool) int {
+	for i, span := range spans {
+		if match(span) {
+			return i
+		}
+	}
+	return -1
+}
+
+// diffFields describes every field, and every Meta and Metrics key, that differs between the two spans.
+func diffFields(expected, actual Span) []string {
+	differences := []string{}
+	expectedValue, actualValue := reflect.ValueOf(expected), reflect.ValueOf(actual)
+	for i := 0; i < expectedValue.NumField(); i++ {
+		name := expectedValue.Type().Field(i).Name
+		if name == "Meta" || name == "Metrics" {
+			continue
+		}
+		if e, a := expectedValue.Field(i).Interface(), actualValue.Field(i).Interface(); !reflect.DeepEqual(e, a) {
+			differences = append(differences, fmt.Sprintf("%s: expected %s, got %s", name, formatGolden(e), formatGolden(a)))
+		}
+	}
+	differences = append(differences, diffMap("Meta", expected.Meta, actual.Meta)...)
+	differences = append(differences, diffMap("Metrics", expected.Metrics, actual.Metrics)...)
+	return differences
+}
+
+// formatGolden quotes strings so that empty values remain visible in a diff.
+func formatGolden(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// diffMap describes every key whose value differs between the two maps, including keys missing from either map.
+func diffMap[V comparable](name string, expected, actual map[string]V) []string {
+	keys := []string{}
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	differences := []string{}
+	for _, key := range keys {
+		e, expectedOK := expected[key]
+		a, actualOK := actual[key]
+		switch {
+		case !actualOK:
+			differences = append(differences, fmt.Sprintf("%s[%s]: expected %s, missing", name, key, formatGolden(e)))
+		case !expectedOK:
+			differences = append(differences, fmt.Sprintf("%s[%s]: unexpected %s", name, key, formatGolden(a)))
+		case e != a:
+			differences = append(differences, fmt.Sprintf("%s[%s]: expected %s, got %s", name, key, formatGolden(e), formatGolden(a)))
+		}
+	}
+	return differences
+}
@@ -0,0 +1,95 @@
+package doghouse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpectMatchesGolden(t *testing.T) {
+	recorded := newMockDatadogServer()
+	recorded.store(Span{Name: "root", Service: "web", Start: 1, Duration: 10, SpanID: 1, TraceID: 1, Meta: map[string]string{"env": "test"}})
+	recorded.store(Span{Name: "child", Service: "db", Start: 2, Duration: 5, SpanID: 2, TraceID: 1, ParentID: 1, Metrics: map[string]float64{"rows": 1}})
+
+	path := filepath.Join(t.TempDir(), "golden.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create golden file: %v", err)
+	}
+	if err := recorded.SaveJSON(f); err != nil {
+		t.Fatalf("failed to save golden file: %v", err)
+	}
+	f.Close()
+
+	s := newMockDatadogServer()
+	s.store(Span{Name: "child", Service: "db", Start: 20, Duration: 7, SpanID: 4, TraceID: 3, ParentID: 5, Metrics: map[string]float64{"rows": 1}})
+	s.store(Span{Name: "root", Service: "web", Start: 10, Duration: 12, SpanID: 5, TraceID: 3, Meta: map[string]string{"env": "test"}})
+	s.ExpectMatchesGolden(t, path)
+
+	s.store(Span{Name: "extra", SpanID: 6})
+	if err := s.CheckMatchesGolden(path); err == nil || !strings.Contains(err.Error(), `unexpected span "extra"`) {
+		t.Fatalf("expected unexpected span to be reported, got %v", err)
+	}
+
+	s.Reset()
+	s.store(Span{Name: "root", Service: "api", SpanID: 1, Meta: map[string]string{"env": "prod"}})
+	err = s.CheckMatchesGolden(path)
+	if err == nil {
+		t.Fatal("expected mismatched spans to fail")
+	}
+	for _, difference := range []string{`Service: expected "web", got "api"`, `Meta[env]: expected "test", got "prod"`, `missing span "child"`} {
+		if !strings.Contains(err.Error(), difference) {
+			t.Fatalf("expected error to contain %s, got %v", difference, err)
+		}
+	}
+
+	strict := newMockDatadogServer(WithGoldenIgnoreFields("SpanID", "TraceID", "ParentID"))
+	strict.store(Span{Name: "root", Service: "web", Start: 1, Duration: 10, SpanID: 7, Meta: map[string]string{"env": "test"}})
+	strict.store(Span{Name: "child", Service: "db", Start: 2, Duration: 6, SpanID: 8, ParentID: 7, Metrics: map[string]float64{"rows": 1}})
+	if err := strict.CheckMatchesGolden(path); err == nil || !strings.Contains(err.Error(), "Duration: expected 5, got 6") {
+		t.Fatalf("expected duration difference to be reported, got %v", err)
+	}
+}
+
+func TestDiffSpans(t *testing.T) {
+	before := []Span{
+		{Name: "root", Service: "web", Start: 1, SpanID: 1, TraceID: 1},
+		{Name: "child", Service: "db", Start: 2, SpanID: 2, TraceID: 1, ParentID: 1},
+	}
+	after := []Span{
+		{Name: "child", Service: "db", Start: 20, SpanID: 20, TraceID: 10, ParentID: 10, Meta: map[string]string{"flag": "on"}},
+		{Name: "root", Service: "web", Start: 10, SpanID: 10, TraceID: 10},
+	}
+
+	if diff := DiffSpans(before, before[:1:1]); diff != "  missing span \"child\"\n" {
+		t.Fatalf("unexpected diff for a removed span: %q", diff)
+	}
+	if diff := DiffSpans(before, after); diff != "  span \"child\":\n    Meta[flag]: unexpected \"on\"\n" {
+		t.Fatalf("unexpected diff: %q", diff)
+	}
+	after[0].Meta = nil
+	if diff := DiffSpans(before, after); diff != "" {
+		t.Fatalf("expected volatile fields to be ignored, got: %q", diff)
+	}
+}
+
+func TestDiffSpansLinks(t *testing.T) {
+	run := func(base uint64) []Span {
+		return []Span{
+			{Name: "producer", SpanID: base + 1, TraceID: base},
+			{Name: "consumer", SpanID: base + 2, TraceID: base + 100, Links: []SpanLink{
+				{TraceID: base, TraceIDHigh: base, SpanID: base + 1, Attributes: map[string]string{"kind": "follows"}},
+			}},
+		}
+	}
+	before, after := run(1), run(1000)
+
+	if diff := DiffSpans(before, after); diff != "" {
+		t.Fatalf("expected span link IDs to be ignored across runs, got: %q", diff)
+	}
+	after[1].Links[0].Attributes["kind"] = "batch"
+	if diff := DiffSpans(before, after); diff == "" {
+		t.Fatal("expected span link attributes to still be compared")
+	}
+}
@@ -0,0 +1,95 @@
+package doghouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// SaveJSON writes every received span to w as an indented JSON array sorted by Start, the same spans returned
+// by Snapshot.
+func (s *MockDatadogServer) SaveJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.Snapshot()); err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+	return nil
+}
+
+// LoadJSON replaces the server's state with the spans in a JSON array written by SaveJSON, rebuilding every
+// index as if the spans had been received. Spans sharing a full 128-bit trace ID are treated as a single trace. The
+// server is left untouched if the array cannot be decoded.
+func (s *MockDatadogServer) LoadJSON(r io.Reader) error {
+	var spans []Span
+	if err := json.NewDecoder(r).Decode(&spans); err != nil {
+		return fmt.Errorf("failed to decode spans: %w", err)
+	}
+
+	batch := Batch{}
+	traces := map[string]int{}
+	for j, traceID := range loadedTraceIDs(spans) {
+		i, ok := traces[traceID]
+		if !ok {
+			i = len(batch)
+			traces[traceID] = i
+			batch = append(batch, Trace{})
+		}
+		batch[i] = append(batch[i], spans[j])
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.clear()
+	for _, trace := range batch {
+		traceID := chunkTraceID(trace)
+		for _, span := range trace {
+			s.storeInTrace(span, traceID)
+		}
+	}
+	s.traceCount = len(batch)
+	s.cond.Broadcast()
+	return nil
+}
+
+// loadedTraceIDs returns the full trace ID of each span. The tracer only tags the first span of each chunk with the
+// upper trace ID bits, so an untagged span takes the ID of its parent, or of the only tagged trace sharing its lower
+// bits when its parent was not saved.
+func loadedTraceIDs(spans []Span) []string {
+	byID := make(map[uint64]int, len(spans))
+	tagged := map[uint64][]string{}
+	for i, span := range spans {
+		byID[span.SpanID] = i
+		if _, ok := span.Meta[traceIDHighTag]; ok && !slices.Contains(tagged[span.TraceID], FullTraceID(span)) {
+			tagged[span.TraceID] = append(tagged[span.TraceID], FullTraceID(span))
+		}
+	}
+
+	ids := make([]string, len(spans))
+	var resolve func(i, depth int) string
+	resolve = func(i, depth int) string {
+		if ids[i] != "" {
+			return ids[i]
+		}
+		span := spans[i]
+		parent, hasParent := byID[span.ParentID]
+		_, isTagged := span.Meta[traceIDHighTag]
+		switch {
+		case isTagged:
+			ids[i] = FullTraceID(span)
+		case span.ParentID != 0 && hasParent && spans[parent].TraceID == span.TraceID && depth < len(spans):
+			ids[i] = resolve(parent, depth+1)
+		case len(tagged[span.TraceID]) == 1:
+			ids[i] = tagged[span.TraceID][0]
+		default:
+			ids[i] = FullTraceID(span)
+		}
+		return ids[i]
+	}
+	for i := range spans {
+		resolve(i, 0)
+	}
+	return ids
+}
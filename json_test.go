@@ -0,0 +1,81 @@
+package doghouse
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSaveAndLoadJSON(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "root", Service: "web", Start: 1, SpanID: 1, TraceID: 2, Meta: map[string]string{traceIDHighTag: "0000000000000003", "env": "test"}},
+		{Name: "child", Service: "db", Start: 2, SpanID: 4, TraceID: 2, ParentID: 1, Metrics: map[string]float64{"rows": 5}},
+	}})
+
+	var buf bytes.Buffer
+	if err := s.SaveJSON(&buf); err != nil {
+		t.Fatalf("failed to save spans: %v", err)
+	}
+
+	loaded := newMockDatadogServer()
+	loaded.store(Span{Name: "stale", SpanID: 99})
+	if err := loaded.LoadJSON(&buf); err != nil {
+		t.Fatalf("failed to load spans: %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded.Snapshot(), s.Snapshot()) {
+		t.Fatalf("loaded spans do not match saved spans:\n%+v\n%+v", loaded.Snapshot(), s.Snapshot())
+	}
+	if loaded.HasSpan("stale") {
+		t.Fatal("expected loading to replace existing spans")
+	}
+	loaded.ExpectSpan(t, "child", "root")
+	loaded.ExpectSpanWithService(t, "child", "db")
+	if trace := loaded.GetTrace("00000000000000030000000000000002"); len(trace) != 2 {
+		t.Fatalf("expected trace to be indexed by its full id, got %+v", trace)
+	}
+	if children := loaded.GetChildren(1); len(children) != 1 || children[0].Name != "child" {
+		t.Fatalf("unexpected children: %+v", children)
+	}
+
+	if err := loaded.LoadJSON(strings.NewReader("not json")); err == nil {
+		t.Fatal("expected invalid json to fail")
+	}
+	loaded.ExpectSpan(t, "root")
+}
+
+func TestLoadJSONFullTraceIDs(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{
+		{
+			{Name: "a.root", Start: 1, SpanID: 1, TraceID: 7, Meta: map[string]string{traceIDHighTag: "6553f2a400000000"}},
+			{Name: "a.child", Start: 3, SpanID: 3, TraceID: 7, ParentID: 1},
+		},
+		{
+			{Name: "b.root", Start: 2, SpanID: 2, TraceID: 7, Meta: map[string]string{traceIDHighTag: "6553f2a500000000"}},
+			{Name: "b.child", Start: 4, SpanID: 4, TraceID: 7, ParentID: 2},
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := s.SaveJSON(&buf); err != nil {
+		t.Fatalf("failed to save spans: %v", err)
+	}
+	loaded := newMockDatadogServer()
+	if err := loaded.LoadJSON(&buf); err != nil {
+		t.Fatalf("failed to load spans: %v", err)
+	}
+
+	loaded.ExpectTraceCount(t, 2)
+	for traceID, names := range map[string][]string{
+		"6553f2a4000000000000000000000007": {"a.root", "a.child"},
+		"6553f2a5000000000000000000000007": {"b.root", "b.child"},
+	} {
+		trace := loaded.GetTrace(traceID)
+		if len(trace) != 2 || trace[0].Name != names[0] || trace[1].Name != names[1] {
+			t.Fatalf("expected trace %s to hold %v, got %+v", traceID, names, trace)
+		}
+	}
+}
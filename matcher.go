@@ -0,0 +1,176 @@
+package doghouse
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SpanMatcher declaratively matches spans. Only the fields that are set are compared, so the zero value matches
+// every span.
+type SpanMatcher struct {
+	Name        string
+	Service     string
+	Resource    string
+	Type        string
+	Meta        map[string]string
+	MinDuration time.Duration
+	HasError    *bool
+}
+
+// Match reports whether the span satisfies every field set on the matcher. Every key in Meta must be present on
+// the span with the same value.
+func (m SpanMatcher) Match(span Span) bool {
+	if m.Name != "" && span.Name != m.Name {
+		return false
+	}
+	if m.Service != "" && span.Service != m.Service {
+		return false
+	}
+	if m.Resource != "" && span.Resource != m.Resource {
+		return false
+	}
+	if m.Type != "" && span.Type != m.Type {
+		return false
+	}
+	for key, value := range m.Meta {
+		if actual, ok := span.Meta[key]; !ok || actual != value {
+			return false
+		}
+	}
+	if time.Duration(span.Duration) < m.MinDuration {
+		return false
+	}
+	if m.HasError != nil && (span.Error != 0) != *m.HasError {
+		return false
+	}
+	return true
+}
+
+// String describes the fields set on the matcher.
+func (m SpanMatcher) String() string {
+	fields := []string{}
+	if m.Name != "" {
+		fields = append(fields, fmt.Sprintf("name=%q", m.Name))
+	}
+	if m.Service != "" {
+		fields = append(fields, fmt.Sprintf("service=%q", m.Service))
+	}
+	if m.Resource != "" {
+		fields = append(fields, fmt.Sprintf("resource=%q", m.Resource))
+	}
+	if m.Type != "" {
+		fields = append(fields, fmt.Sprintf("type=%q", m.Type))
+	}
+	if len(m.Meta) > 0 {
+		keys := make([]string, 0, len(m.Meta))
+		for key := range m.Meta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fields = append(fields, fmt.Sprintf("meta[%s]=%q", key, m.Meta[key]))
+		}
+	}
+	if m.MinDuration > 0 {
+		fields = append(fields, fmt.Sprintf("duration>=%v", m.MinDuration))
+	}
+	if m.HasError != nil {
+		fields = append(fields, fmt.Sprintf("error=%t", *m.HasError))
+	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// findMatch reports whether any received span satisfies the matcher, the caller must hold the read lock.
+func (s *MockDatadogServer) findMatch(m SpanMatcher) bool {
+	spans := s.spans.ByName(m.Name)
+	if m.Name == "" {
+		spans = s.allSpans()
+	}
+	for _, span := range spans {
+		if m.Match(span) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpectMatch ensures that a span satisfying the matcher was received.
+func (s *MockDatadogServer) ExpectMatch(t testing.TB, m SpanMatcher) {
+	t.Helper()
+
+	if err := s.CheckMatch(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckMatch returns an error unless a span satisfying the matcher was received.
+func (s *MockDatadogServer) CheckMatch(m SpanMatcher) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.findMatch(m) {
+		return fmt.Errorf("no span matching %v found in spans: %v", m, s.spanNames())
+	}
+	return nil
+}
+
+// WaitForMatch waits the default wait timeout for the server to receive a span satisfying the matcher.
+func (s *MockDatadogServer) WaitForMatch(t testing.TB, m SpanMatcher) {
+	t.Helper()
+
+	ctx, cancel := s.withTimeout(s.waitTimeout)
+	defer cancel()
+
+	if err := s.AwaitMatch(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AwaitMatch waits until the server receives a span satisfying the matcher, returning an error if the context is
+// done first.
+func (s *MockDatadogServer) AwaitMatch(ctx context.Context, m SpanMatcher) error {
+	return s.waitUntil(ctx, func() error {
+		if !s.findMatch(m) {
+			return pending("unable to find span matching %v in spans: %v", m, s.spanNames())
+		}
+		return nil
+	})
+}
+
+// CountMatching returns how many received spans satisfy the predicate. The predicate is called with copies of the
+// spans outside of the server's lock.
+func (s *MockDatadogServer) CountMatching(fn func(span Span) bool) int {
+	count := 0
+	for _, span := range s.Snapshot() {
+		if fn(span) {
+			count++
+		}
+	}
+	return count
+}
+
+// CountMatcher returns how many received spans satisfy the matcher.
+func (s *MockDatadogServer) CountMatcher(m SpanMatcher) int {
+	return s.CountMatching(m.Match)
+}
+
+// ExpectCountMatching ensures that exactly count received spans satisfy the predicate.
+func (s *MockDatadogServer) ExpectCountMatching(t testing.TB, fn func(span Span) bool, count int) {
+	t.Helper()
+
+	if err := s.CheckCountMatching(fn, count); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckCountMatching returns an error unless exactly count received spans satisfy the predicate.
+func (s *MockDatadogServer) CheckCountMatching(fn func(span Span) bool, count int) error {
+	if actual := s.CountMatching(fn); actual != count {
+		return fmt.Errorf("expected %d spans to match, found %d", count, actual)
+	}
+	return nil
+}
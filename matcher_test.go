@@ -0,0 +1,75 @@
+package doghouse
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpanMatcher(t *testing.T) {
+	yes, no := true, false
+	span := Span{Name: "query", Service: "db", Resource: "SELECT 1", Type: "sql", Duration: int64(5 * time.Millisecond), Error: 1, Meta: map[string]string{"db.type": "postgres"}}
+
+	for _, m := range []SpanMatcher{
+		{},
+		{Name: "query", Service: "db"},
+		{Resource: "SELECT 1", Type: "sql"},
+		{Meta: map[string]string{"db.type": "postgres"}, MinDuration: 5 * time.Millisecond, HasError: &yes},
+	} {
+		if !m.Match(span) {
+			t.Fatalf("expected %v to match", m)
+		}
+	}
+	for _, m := range []SpanMatcher{
+		{Name: "other"},
+		{Service: "web"},
+		{Meta: map[string]string{"db.type": "mysql"}},
+		{Meta: map[string]string{"db.instance": "users"}},
+		{MinDuration: time.Second},
+		{HasError: &no},
+	} {
+		if m.Match(span) {
+			t.Fatalf("expected %v not to match", m)
+		}
+	}
+}
+
+func TestExpectMatch(t *testing.T) {
+	s := newMockDatadogServer(WithDefaultWaitTimeout(time.Second))
+	s.store(Span{Name: "query", Service: "db", SpanID: 1})
+
+	s.ExpectMatch(t, SpanMatcher{Service: "db"})
+	err := s.CheckMatch(SpanMatcher{Name: "query", Service: "web"})
+	if err == nil || !strings.Contains(err.Error(), `name="query", service="web"`) {
+		t.Fatalf("expected the matcher to be described, got %v", err)
+	}
+
+	req := batchRequest(t, Batch{{{Name: "request", Service: "web", SpanID: 2}}})
+	go s.ServeHTTP(httptest.NewRecorder(), req)
+	s.WaitForMatch(t, SpanMatcher{Name: "request", Service: "web"})
+}
+
+func TestCountMatching(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "query", Service: "db", SpanID: 1, Error: 1})
+	s.store(Span{Name: "query", Service: "db", SpanID: 2, Error: 1})
+	s.store(Span{Name: "query", Service: "db", SpanID: 3})
+	s.store(Span{Name: "request", Service: "web", SpanID: 4, Error: 1})
+
+	erroredDB := func(span Span) bool {
+		return span.Service == "db" && span.Error != 0
+	}
+	if count := s.CountMatching(erroredDB); count != 2 {
+		t.Fatalf("unexpected count %d", count)
+	}
+	yes := true
+	if count := s.CountMatcher(SpanMatcher{HasError: &yes}); count != 3 {
+		t.Fatalf("unexpected matcher count %d", count)
+	}
+
+	s.ExpectCountMatching(t, erroredDB, 2)
+	if err := s.CheckCountMatching(erroredDB, 3); err == nil {
+		t.Fatal("expected mismatched count to fail")
+	}
+}
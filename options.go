@@ -0,0 +1,137 @@
+package doghouse
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Option configures a MockDatadogServer created with NewWithOptions.
+type Option func(s *MockDatadogServer)
+
+// WithTracerOptions sets the options used to start the global tracer.
+func WithTracerOptions(opts ...tracer.StartOption) Option {
+	return func(s *MockDatadogServer) {
+		s.tracerOptions = append(s.tracerOptions, opts...)
+	}
+}
+
+// WithPollInterval sets how often waiting assertions re-check their expectations in addition to being woken
+// whenever spans are received. It defaults to 1 millisecond, a non-positive interval disables periodic checks.
+func WithPollInterval(d time.Duration) Option {
+	return func(s *MockDatadogServer) {
+		s.pollInterval = d
+	}
+}
+
+// WithDefaultWaitTimeout sets how long the short-form helpers such as WaitForSpan wait for spans to arrive. It
+// defaults to 10 milliseconds, which may need to be relaxed on busy machines where flushes are slow.
+func WithDefaultWaitTimeout(d time.Duration) Option {
+	return func(s *MockDatadogServer) {
+		s.waitTimeout = d
+	}
+}
+
+// WithDefaultNoSpanTimeout sets how long ExpectNoSpan waits to ensure a span is not received. It defaults to 100
+// milliseconds.
+func WithDefaultNoSpanTimeout(d time.Duration) Option {
+	return func(s *MockDatadogServer) {
+		s.noSpanTimeout = d
+	}
+}
+
+// WithStrictPaths makes the server respond with 404 to requests for any path it does not handle, surfacing a
+// tracer that posts to the wrong endpoint instead of silently accepting its requests. By default such requests
+// receive an empty 200 response.
+func WithStrictPaths() Option {
+	return func(s *MockDatadogServer) {
+		s.strictPaths = true
+	}
+}
+
+// WithStrictTraceCount rejects batches whose number of traces does not match the X-Datadog-Trace-Count header,
+// recording a decode error and discarding their spans. By default a mismatch is only logged and the spans are
+// stored, since some tracers count trace chunks rather than traces in the header.
+func WithStrictTraceCount() Option {
+	return func(s *MockDatadogServer) {
+		s.strictTraceCount = true
+	}
+}
+
+// WithTLS serves the trace endpoints over HTTPS with a self-signed certificate so that the tracer's TLS transport
+// is exercised. DD_TRACE_AGENT_URL is set to the https URL and the tracer is started with an HTTP client that trusts
+// the certificate unless WithTracerOptions sets its own client, which can trust it using Certificate or TLSConfig.
+// The option is passed to NewWithOptions, since New only accepts tracer options.
+func WithTLS() Option {
+	return func(s *MockDatadogServer) {
+		s.tlsEnabled = true
+	}
+}
+
+// WithLogger routes the server's diagnostic output, such as decode failures, to the given logger instead of the
+// standard library's default logger.
+func WithLogger(logger Logger) Option {
+	return func(s *MockDatadogServer) {
+		s.logger = logger
+	}
+}
+
+// WithSilentLogging discards all of the server's diagnostic output.
+func WithSilentLogging() Option {
+	return WithLogger(log.New(io.Discard, "", 0))
+}
+
+// WithOTLP starts a second listener that accepts spans exported by OpenTelemetry's OTLP/gRPC exporter. Received
+// spans are translated into Spans and stored alongside those sent by the Datadog tracer. The address of the
+// listener is returned by OTLPAddress.
+func WithOTLP() Option {
+	return func(s *MockDatadogServer) {
+		s.otlpEnabled = true
+	}
+}
+
+// WithGoldenIgnoreFields replaces the Span fields ignored when comparing against a golden file, which default to
+// Start, Duration, SpanID, TraceID, ParentID, and the trace and span IDs of span links. Individual tags can be
+// ignored with Meta.<key> or Metrics.<key>, and span link fields with Links.<field>.
+func WithGoldenIgnoreFields(fields ...string) Option {
+	return func(s *MockDatadogServer) {
+		s.goldenIgnoreFields = fields
+	}
+}
+
+// WithDurationWarnings logs a warning whenever a span is received with a zero or negative duration, which usually
+// means custom instrumentation finished a span before starting it. ExpectPositiveDurations asserts the same after
+// the fact.
+func WithDurationWarnings() Option {
+	return func(s *MockDatadogServer) {
+		s.warnDurations = true
+	}
+}
+
+// WithNormalizationPattern replaces the pattern ExpectResourceNormalized uses to find literal values in resources,
+// which by default matches single quoted strings and standalone numbers.
+func WithNormalizationPattern(pattern *regexp.Regexp) Option {
+	return func(s *MockDatadogServer) {
+		s.normalizationPattern = pattern
+	}
+}
+
+// WithStore replaces the in-memory maps that hold received spans with the given store, such as one that bounds
+// memory during soak tests. The store is reset when the server is created and whenever the server is reset.
+func WithStore(store SpanStore) Option {
+	return func(s *MockDatadogServer) {
+		s.spans = store
+	}
+}
+
+// WithClock replaces the real clock used for wait timeouts, poll intervals, response delays, and the time spans
+// are received, so that tests can advance time manually. Contexts passed to the Await methods keep their own
+// deadlines.
+func WithClock(clock Clock) Option {
+	return func(s *MockDatadogServer) {
+		s.clock = clock
+	}
+}
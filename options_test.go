@@ -0,0 +1,130 @@
+package doghouse
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithPollInterval(t *testing.T) {
+	s := newMockDatadogServer()
+	if s.pollInterval != time.Millisecond {
+		t.Fatalf("unexpected default poll interval: %v", s.pollInterval)
+	}
+
+	for _, interval := range []time.Duration{0, 50 * time.Millisecond} {
+		s = newMockDatadogServer(WithPollInterval(interval))
+		if s.pollInterval != interval {
+			t.Fatalf("unexpected poll interval: %v", s.pollInterval)
+		}
+
+		req := batchRequest(t, Batch{{{Name: "poll", SpanID: 1}}})
+		go s.ServeHTTP(httptest.NewRecorder(), req)
+		s.WaitDurationForSpan(t, time.Second, "poll")
+		s.ExpectDurationNoSpan(t, 10*time.Millisecond, "other")
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	s := newMockDatadogServer(WithLogger(log.New(&buf, "", 0)))
+
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, strings.NewReader("not msgpack"))
+	req.Header.Set(traceHeader, "1")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(buf.String(), "failed to parse trace") {
+		t.Fatalf("expected decode failure to be logged, got: %q", buf.String())
+	}
+}
+
+func TestWithDefaultTimeouts(t *testing.T) {
+	s := newMockDatadogServer()
+	if s.waitTimeout != 10*time.Millisecond || s.noSpanTimeout != 100*time.Millisecond {
+		t.Fatalf("unexpected default timeouts: wait=%v, no span=%v", s.waitTimeout, s.noSpanTimeout)
+	}
+
+	s = newMockDatadogServer(WithDefaultWaitTimeout(time.Second), WithDefaultNoSpanTimeout(200*time.Millisecond))
+
+	req := batchRequest(t, Batch{{{Name: "slow", SpanID: 1}}})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	s.WaitForSpan(t, "slow")
+
+	start := time.Now()
+	s.ExpectNoSpan(t, "other")
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected no span timeout to be used, waited %v", elapsed)
+	}
+}
+
+func TestWithStrictPaths(t *testing.T) {
+	for _, test := range []struct {
+		opts []Option
+		code int
+	}{
+		{code: http.StatusOK},
+		{opts: []Option{WithStrictPaths()}, code: http.StatusNotFound},
+	} {
+		s := newMockDatadogServer(test.opts...)
+		s.Handle("/handled", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v0.2/traces", http.NoBody))
+		if recorder.Code != test.code {
+			t.Fatalf("unexpected status for unknown path %d, expected %d", recorder.Code, test.code)
+		}
+
+		recorder = httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/handled", http.NoBody))
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("unexpected status for handled path %d", recorder.Code)
+		}
+
+		if code := postBatch(t, s, Batch{{{Name: "strict", SpanID: 1}}}).Code; code != http.StatusOK {
+			t.Fatalf("unexpected status for trace path %d", code)
+		}
+		s.ExpectSpan(t, "strict")
+	}
+}
+
+// countingStore is a SpanStore that records how many spans it was given.
+type countingStore struct {
+	*mapStore
+	puts int
+}
+
+func (s *countingStore) Put(span Span) {
+	s.puts++
+	s.mapStore.Put(span)
+}
+
+func TestWithStore(t *testing.T) {
+	store := &countingStore{mapStore: newMapStore()}
+	s := newMockDatadogServer(WithStore(store))
+	postBatch(t, s, Batch{{
+		{Name: "root", SpanID: 1, TraceID: 1},
+		{Name: "child", SpanID: 2, TraceID: 1, ParentID: 1},
+	}})
+
+	if store.puts != 2 {
+		t.Fatalf("expected spans to be put in the store, got %d", store.puts)
+	}
+	s.ExpectSpan(t, "child", "root")
+	if spans := store.ByName("child"); len(spans) != 1 || spans[0].ParentID != 1 {
+		t.Fatalf("unexpected spans in store: %+v", spans)
+	}
+
+	s.Reset()
+	if len(store.All()) != 0 {
+		t.Fatal("expected reset to reset the store")
+	}
+}
@@ -0,0 +1,283 @@
+package doghouse
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+)
+
+const (
+	serviceNameAttribute  = "service.name"
+	resourceNameAttribute = "resource.name"
+	spanTypeAttribute     = "span.type"
+)
+
+// otlpService implements the OTLP TraceService by storing the exported spans in the server.
+type otlpService struct {
+	coltracepb.UnimplementedTraceServiceServer
+	server *MockDatadogServer
+}
+
+// Export translates the exported spans and stores them as a single batch.
+func (o *otlpService) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	o.server.ingest(otlpBatch(req.GetResourceSpans()))
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+// startOTLP starts the gRPC listener for OTLP traces on a random local port.
+func (s *MockDatadogServer) startOTLP() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	s.otlpListener = listener
+	s.otlpServer = grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(s.otlpServer, &otlpService{server: s})
+	go func() {
+		if err := s.otlpServer.Serve(listener); err != nil {
+			s.logger.Printf("OTLP listener stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// OTLPAddress returns the host and port of the OTLP/gRPC listener or an empty string if the server was not
+// created with WithOTLP.
+func (s *MockDatadogServer) OTLPAddress() string {
+	if s.otlpListener == nil {
+		return ""
+	}
+	return s.otlpListener.Addr().String()
+}
+
+// otlpBatch translates OTLP spans into a batch with one trace per 128-bit trace ID, in the order each trace was
+// first seen.
+func otlpBatch(resourceSpans []*tracepb.ResourceSpans) Batch {
+	batch := Batch{}
+	traces := map[string]int{}
+	for _, resourceSpan := range resourceSpans {
+		resource := resourceSpan.GetResource().GetAttributes()
+		for _, scopeSpan := range resourceSpan.GetScopeSpans() {
+			for _, otlpSpan := range scopeSpan.GetSpans() {
+				span := fromOTLP(otlpSpan, resource)
+				traceID := FullTraceID(span)
+				i, ok := traces[traceID]
+				if !ok {
+					i = len(batch)
+					traces[traceID] = i
+					batch = append(batch, Trace{})
+				}
+				batch[i] = append(batch[i], span)
+			}
+		}
+	}
+	return batch
+}
+
+// fromOTLP translates an OTLP span into a Span. The upper 64 bits of the trace ID are recorded in the _dd.p.tid
+// meta tag, resource attributes are merged with the span's attributes, and an error status sets Error. The
+// resource defaults to the span name unless a resource.name attribute is set.
+func fromOTLP(otlpSpan *tracepb.Span, resource []*commonpb.KeyValue) Span {
+	span := Span{
+		Name:     otlpSpan.GetName(),
+		Resource: otlpSpan.GetName(),
+		Start:    int64(otlpSpan.GetStartTimeUnixNano()),
+		Duration: int64(otlpSpan.GetEndTimeUnixNano() - otlpSpan.GetStartTimeUnixNano()),
+		Meta:     map[string]string{},
+		Metrics:  map[string]float64{},
+		SpanID:   otlpID(otlpSpan.GetSpanId()),
+		ParentID: otlpID(otlpSpan.GetParentSpanId()),
+	}
+
+	traceID := otlpSpan.GetTraceId()
+	if len(traceID) == 16 {
+		if high := binary.BigEndian.Uint64(traceID[:8]); high != 0 {
+			span.Meta[traceIDHighTag] = fmt.Sprintf("%016x", high)
+		}
+		span.TraceID = binary.BigEndian.Uint64(traceID[8:])
+	}
+
+	addAttributes(&span, resource)
+	addAttributes(&span, otlpSpan.GetAttributes())
+	span.Service = span.Meta[serviceNameAttribute]
+	span.Type = span.Meta[spanTypeAttribute]
+	if resource, ok := span.Meta[resourceNameAttribute]; ok {
+		span.Resource = resource
+	}
+
+	if kind := otlpKind(otlpSpan.GetKind()); kind != "" {
+		span.Meta[ext.SpanKind] = kind
+	}
+	if status := otlpSpan.GetStatus(); status.GetCode() == tracepb.Status_STATUS_CODE_ERROR {
+		span.Error = 1
+		if status.GetMessage() != "" {
+			span.Meta[ext.ErrorMsg] = status.GetMessage()
+		}
+	}
+	return span
+}
+
+// otlpID decodes an 8 byte OTLP span ID, returning 0 for an empty or malformed ID.
+func otlpID(id []byte) uint64 {
+	if len(id) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(id)
+}
+
+// addAttributes records string and boolean attributes as Meta tags and numeric attributes as Metrics. Array,
+// map, and byte values have no Datadog equivalent and are skipped.
+func addAttributes(span *Span, attributes []*commonpb.KeyValue) {
+	for _, attribute := range attributes {
+		switch value := attribute.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			span.Meta[attribute.GetKey()] = value.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			span.Meta[attribute.GetKey()] = strconv.FormatBool(value.BoolValue)
+		case *commonpb.AnyValue_IntValue:
+			span.Metrics[attribute.GetKey()] = float64(value.IntValue)
+		case *commonpb.AnyValue_DoubleValue:
+			span.Metrics[attribute.GetKey()] = value.DoubleValue
+		}
+	}
+}
+
+// otlpKind returns the span.kind tag value for an OTLP span kind.
+func otlpKind(kind tracepb.Span_SpanKind) string {
+	switch kind {
+	case tracepb.Span_SPAN_KIND_SERVER:
+		return ext.SpanKindServer
+	case tracepb.Span_SPAN_KIND_CLIENT:
+		return ext.SpanKindClient
+	case tracepb.Span_SPAN_KIND_PRODUCER:
+		return ext.SpanKindProducer
+	case tracepb.Span_SPAN_KIND_CONSUMER:
+		return ext.SpanKindConsumer
+	case tracepb.Span_SPAN_KIND_INTERNAL:
+		return ext.SpanKindInternal
+	default:
+		return ""
+	}
+}
+
+// ExportOTLP encodes every received span as an OTLP TracesData protobuf with one ResourceSpans per service so
+// that the spans can be loaded into OpenTelemetry tooling. Trace IDs are expanded to 128 bits using the _dd.p.tid
+// meta tag of their trace chunk, Meta and Metrics become attributes, and errored spans get an error status.
+func (s *MockDatadogServer) ExportOTLP() ([]byte, error) {
+	s.lock.RLock()
+	services := map[string][]*tracepb.Span{}
+	starts := map[*tracepb.Span]int64{}
+	for traceID, spans := range s.spansByTrace {
+		id, err := hex.DecodeString(traceID)
+		if err != nil {
+			s.lock.RUnlock()
+			return nil, fmt.Errorf("invalid trace id %q: %w", traceID, err)
+		}
+		for _, span := range spans {
+			otlpSpan := toOTLP(span, id)
+			services[span.Service] = append(services[span.Service], otlpSpan)
+			starts[otlpSpan] = span.Start
+		}
+	}
+	s.lock.RUnlock()
+
+	names := make([]string, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+
+	data := &tracepb.TracesData{}
+	for _, service := range names {
+		spans := services[service]
+		sort.SliceStable(spans, func(i, j int) bool {
+			return starts[spans[i]] < starts[spans[j]]
+		})
+		data.ResourceSpans = append(data.ResourceSpans, &tracepb.ResourceSpans{
+			Resource:   &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringValue(serviceNameAttribute, service)}},
+			ScopeSpans: []*tracepb.ScopeSpans{{Spans: spans}},
+		})
+	}
+	return proto.Marshal(data)
+}
+
+// toOTLP translates a Span into an OTLP span with the given 128-bit trace ID.
+func toOTLP(span Span, traceID []byte) *tracepb.Span {
+	otlpSpan := &tracepb.Span{
+		TraceId:           traceID,
+		SpanId:            binary.BigEndian.AppendUint64(nil, span.SpanID),
+		Name:              span.Name,
+		Kind:              toOTLPKind(span.Meta[ext.SpanKind]),
+		StartTimeUnixNano: uint64(span.Start),
+		EndTimeUnixNano:   uint64(span.Start + span.Duration),
+		Attributes:        []*commonpb.KeyValue{stringValue(resourceNameAttribute, span.Resource)},
+	}
+	if span.ParentID != 0 {
+		otlpSpan.ParentSpanId = binary.BigEndian.AppendUint64(nil, span.ParentID)
+	}
+	if span.Type != "" {
+		otlpSpan.Attributes = append(otlpSpan.Attributes, stringValue(spanTypeAttribute, span.Type))
+	}
+
+	keys := make([]string, 0, len(span.Meta))
+	for key := range span.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		otlpSpan.Attributes = append(otlpSpan.Attributes, stringValue(key, span.Meta[key]))
+	}
+
+	keys = keys[:0]
+	for key := range span.Metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		otlpSpan.Attributes = append(otlpSpan.Attributes, &commonpb.KeyValue{
+			Key:   key,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: span.Metrics[key]}},
+		})
+	}
+
+	if span.Error != 0 {
+		otlpSpan.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: span.Meta[ext.ErrorMsg]}
+	}
+	return otlpSpan
+}
+
+// stringValue builds an OTLP attribute with a string value.
+func stringValue(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// toOTLPKind returns the OTLP span kind for a span.kind tag value.
+func toOTLPKind(kind string) tracepb.Span_SpanKind {
+	switch kind {
+	case ext.SpanKindServer:
+		return tracepb.Span_SPAN_KIND_SERVER
+	case ext.SpanKindClient:
+		return tracepb.Span_SPAN_KIND_CLIENT
+	case ext.SpanKindProducer:
+		return tracepb.Span_SPAN_KIND_PRODUCER
+	case ext.SpanKindConsumer:
+		return tracepb.Span_SPAN_KIND_CONSUMER
+	case ext.SpanKindInternal:
+		return tracepb.Span_SPAN_KIND_INTERNAL
+	default:
+		return tracepb.Span_SPAN_KIND_UNSPECIFIED
+	}
+}
@@ -0,0 +1,125 @@
+package doghouse
+
+import (
+	"context"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLP(t *testing.T) {
+	s := newMockDatadogServer(WithOTLP())
+	if s.OTLPAddress() != "" {
+		t.Fatal("expected no address before the listener is started")
+	}
+	if err := s.startOTLP(); err != nil {
+		t.Fatalf("failed to start OTLP listener: %v", err)
+	}
+	defer s.Close()
+
+	conn, err := grpc.NewClient(s.OTLPAddress(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial OTLP listener: %v", err)
+	}
+	defer conn.Close()
+
+	traceID := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2}
+	_, err = coltracepb.NewTraceServiceClient(conn).Export(context.Background(), &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringValue("service.name", "checkout")}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{
+					{
+						TraceId:           traceID,
+						SpanId:            []byte{0, 0, 0, 0, 0, 0, 0, 3},
+						Name:              "otlp.request",
+						Kind:              tracepb.Span_SPAN_KIND_SERVER,
+						StartTimeUnixNano: 100,
+						EndTimeUnixNano:   300,
+						Attributes: []*commonpb.KeyValue{
+							stringValue("http.method", "GET"),
+							{Key: "retries", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 2}}},
+						},
+					},
+					{
+						TraceId:           traceID,
+						SpanId:            []byte{0, 0, 0, 0, 0, 0, 0, 4},
+						ParentSpanId:      []byte{0, 0, 0, 0, 0, 0, 0, 3},
+						Name:              "otlp.query",
+						StartTimeUnixNano: 150,
+						EndTimeUnixNano:   250,
+						Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "timeout"},
+					},
+				},
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to export spans: %v", err)
+	}
+
+	s.ExpectSpan(t, "otlp.query", "otlp.request")
+	s.ExpectSpanWithService(t, "otlp.request", "checkout")
+	s.ExpectSpanKind(t, "otlp.request", "server")
+	s.ExpectSpanMeta(t, "otlp.request", map[string]string{"http.method": "GET"})
+	s.ExpectSpanMetric(t, "otlp.request", "retries", 2, 0)
+	s.ExpectErrorSpan(t, "otlp.query")
+
+	span := s.GetSpansByName("otlp.request")[0]
+	if span.SpanID != 3 || span.TraceID != 2 || span.Start != 100 || span.Duration != 200 {
+		t.Fatalf("unexpected span: %+v", span)
+	}
+	if trace := s.GetTrace("00000000000000010000000000000002"); len(trace) != 2 {
+		t.Fatalf("unexpected trace: %+v", trace)
+	}
+	if s.TraceCount() != 1 || s.BatchCount() != 1 {
+		t.Fatalf("unexpected counts: traces=%d, batches=%d", s.TraceCount(), s.BatchCount())
+	}
+}
+
+func TestExportOTLP(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{
+		{Name: "web.request", Service: "web", Resource: "GET /", Type: "web", Start: 10, Duration: 30, SpanID: 1, TraceID: 2, Meta: map[string]string{traceIDHighTag: "0000000000000001", "span.kind": "server"}},
+		{Name: "db.query", Service: "db", Resource: "SELECT 1", Start: 20, Duration: 5, SpanID: 3, TraceID: 2, ParentID: 1, Error: 1, Meta: map[string]string{"error.message": "boom"}, Metrics: map[string]float64{"rows": 4}},
+	}})
+
+	body, err := s.ExportOTLP()
+	if err != nil {
+		t.Fatalf("failed to export spans: %v", err)
+	}
+
+	var data tracepb.TracesData
+	if err := proto.Unmarshal(body, &data); err != nil {
+		t.Fatalf("failed to decode exported spans: %v", err)
+	}
+	if len(data.ResourceSpans) != 2 {
+		t.Fatalf("expected a resource per service, got %d", len(data.ResourceSpans))
+	}
+
+	db := data.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if db.Name != "db.query" || db.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || db.Status.GetMessage() != "boom" {
+		t.Fatalf("unexpected database span: %v", db)
+	}
+
+	imported := newMockDatadogServer()
+	imported.ingest(otlpBatch(data.ResourceSpans))
+	imported.ExpectSpan(t, "db.query", "web.request")
+	imported.ExpectSpanWithService(t, "web.request", "web")
+	imported.ExpectSpanType(t, "web.request", "web")
+	if spans := imported.GetSpansByResource("SELECT 1"); len(spans) != 1 {
+		t.Fatalf("expected resource to round trip, got %+v", spans)
+	}
+	imported.ExpectSpanKind(t, "web.request", "server")
+	imported.ExpectSpanMetric(t, "db.query", "rows", 4, 0)
+	imported.ExpectErrorSpan(t, "db.query")
+	if trace := imported.GetTrace("00000000000000010000000000000002"); len(trace) != 2 {
+		t.Fatalf("expected trace id to be expanded to 128 bits, got %+v", trace)
+	}
+}
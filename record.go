@@ -0,0 +1,66 @@
+package doghouse
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+)
+
+// RecordedRequest is the raw form of a request sent to a trace endpoint, retained with WithRecordRequests. The
+// body is exactly as the tracer sent it, so it is still gzip encoded if the request was compressed.
+type RecordedRequest struct {
+	Path        string
+	ContentType string
+	Header      http.Header
+	Body        []byte
+	Received    time.Time
+}
+
+// WithRecordRequests retains the raw body and headers of the last max requests sent to a trace endpoint, whether or
+// not they could be decoded, so that they can be inspected with RecordedRequests when debugging protocol issues or
+// saved as decoder fixtures. Older requests are discarded once max have been recorded, a non-positive max disables
+// recording, which is the default.
+func WithRecordRequests(max int) Option {
+	return func(s *MockDatadogServer) {
+		s.recordLimit = max
+	}
+}
+
+// record retains the request, discarding the oldest recorded request once the limit is reached. The body is not
+// modified after it has been read, so it is only copied when returned by RecordedRequests.
+func (s *MockDatadogServer) record(r *http.Request, body []byte) {
+	if s.recordLimit < 1 {
+		return
+	}
+	request := RecordedRequest{
+		Path:        r.URL.Path,
+		ContentType: r.Header.Get("Content-Type"),
+		Header:      r.Header.Clone(),
+		Body:        body,
+		Received:    s.clock.Now(),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.recordedRequests) >= s.recordLimit {
+		n := copy(s.recordedRequests, s.recordedRequests[len(s.recordedRequests)-s.recordLimit+1:])
+		s.recordedRequests = s.recordedRequests[:n]
+	}
+	s.recordedRequests = append(s.recordedRequests, request)
+}
+
+// RecordedRequests returns a copy of the requests retained by WithRecordRequests, oldest first. The bodies and
+// headers may be modified, such as to build a fixture, without affecting later calls.
+func (s *MockDatadogServer) RecordedRequests() []RecordedRequest {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	requests := make([]RecordedRequest, 0, len(s.recordedRequests))
+	for _, request := range s.recordedRequests {
+		request.Header = request.Header.Clone()
+		request.Body = bytes.Clone(request.Body)
+		requests = append(requests, request)
+	}
+	return requests
+}
@@ -0,0 +1,55 @@
+package doghouse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithRecordRequests(t *testing.T) {
+	s := newMockDatadogServer(WithRecordRequests(2), WithSilentLogging())
+
+	postBatch(t, s, Batch{{{Name: "first", SpanID: 1}}})
+	postBatch(t, s, Batch{{{Name: "second", SpanID: 2}}})
+
+	req := httptest.NewRequest(http.MethodPost, defaultTracePath, strings.NewReader("not msgpack"))
+	req.Header.Set(traceHeader, "1")
+	req.Header.Set("Content-Type", "application/msgpack")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	requests := s.RecordedRequests()
+	if len(requests) != 2 {
+		t.Fatalf("expected the last 2 requests to be retained, got %d", len(requests))
+	}
+
+	var batch Batch
+	if _, err := batch.UnmarshalMsg(requests[0].Body); err != nil || batch[0][0].Name != "second" {
+		t.Fatalf("expected the oldest retained request to hold the second batch, got %v, %v", batch, err)
+	}
+	if last := requests[1]; string(last.Body) != "not msgpack" || last.ContentType != "application/msgpack" ||
+		last.Path != defaultTracePath || last.Header.Get(traceHeader) != "1" {
+		t.Fatalf("expected the undecodable request to be recorded as sent, got %+v", last)
+	}
+
+	last := requests[1]
+	last.Body[0] = 'N'
+	last.Header.Set(traceHeader, "2")
+	if last := s.RecordedRequests()[1]; string(last.Body) != "not msgpack" || last.Header.Get(traceHeader) != "1" {
+		t.Fatalf("expected recorded requests to be copied, got %+v", last)
+	}
+
+	s.Reset()
+	if requests := s.RecordedRequests(); len(requests) != 0 {
+		t.Fatalf("expected reset to clear recorded requests, got %d", len(requests))
+	}
+}
+
+func TestRecordRequestsDisabled(t *testing.T) {
+	s := newMockDatadogServer()
+	postBatch(t, s, Batch{{{Name: "first", SpanID: 1}}})
+
+	if requests := s.RecordedRequests(); len(requests) != 0 {
+		t.Fatalf("expected no requests to be recorded by default, got %d", len(requests))
+	}
+}
@@ -0,0 +1,250 @@
+package doghouse
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// DurationStats returns the 50th, 90th, and 99th percentile durations of every received span with the given name
+// along with the number of spans they were computed over. Percentiles use the nearest-rank method and are zero
+// when no such span was received.
+func (s *MockDatadogServer) DurationStats(name string) (p50, p90, p99 time.Duration, count int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	durations := s.durations(name)
+	return percentile(durations, 0.5), percentile(durations, 0.9), percentile(durations, 0.99), len(durations)
+}
+
+// durations returns the sorted durations of every span with the given name, the caller must hold the read lock.
+func (s *MockDatadogServer) durations(name string) []time.Duration {
+	spans := s.spans.ByName(name)
+	durations := make([]time.Duration, 0, len(spans))
+	for _, span := range spans {
+		durations = append(durations, time.Duration(span.Duration))
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	return durations
+}
+
+// SumMetric returns the sum of the metric key over every received span with the given name along with the number of
+// those spans that had the metric set.
+func (s *MockDatadogServer) SumMetric(name, key string) (float64, int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var sum float64
+	var count int
+	for _, span := range s.spans.ByName(name) {
+		if value, ok := span.Metrics[key]; ok {
+			sum += value
+			count++
+		}
+	}
+	return sum, count
+}
+
+// AvgDuration returns the mean duration of every received span with the given name, or zero when no such span was
+// received.
+func (s *MockDatadogServer) AvgDuration(name string) time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := s.spans.ByName(name)
+	if len(spans) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, span := range spans {
+		total += time.Duration(span.Duration)
+	}
+	return total / time.Duration(len(spans))
+}
+
+// percentile returns the nearest-rank percentile p, between 0 and 1, of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ExpectP99Under ensures that spans with the given name were received and that their 99th percentile duration is
+// below the threshold.
+func (s *MockDatadogServer) ExpectP99Under(t testing.TB, name string, threshold time.Duration) {
+	t.Helper()
+
+	if err := s.CheckP99Under(name, threshold); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckP99Under returns an error unless spans with the given name were received and their 99th percentile
+// duration is below the threshold.
+func (s *MockDatadogServer) CheckP99Under(name string, threshold time.Duration) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	durations := s.durations(name)
+	if len(durations) == 0 {
+		return fmt.Errorf("span named %q not found in spans: %v", name, s.spanNames())
+	}
+	if p99 := percentile(durations, 0.99); p99 >= threshold {
+		return fmt.Errorf("span named %q p99 duration %v is not under %v (p50=%v, p90=%v, count=%d)", name, p99, threshold, percentile(durations, 0.5), percentile(durations, 0.9), len(durations))
+	}
+	return nil
+}
+
+// SlowestSpans returns a copy of up to n received spans with the longest durations across all traces sorted by
+// descending Duration. Spans with equal durations are ordered by Start.
+func (s *MockDatadogServer) SlowestSpans(n int) []Span {
+	spans := s.slowest()
+	if n < 0 {
+		n = 0
+	}
+	if n < len(spans) {
+		spans = spans[:n]
+	}
+	return spans
+}
+
+// slowest returns a snapshot of every received span sorted by descending Duration.
+func (s *MockDatadogServer) slowest() []Span {
+	spans := s.Snapshot()
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Duration > spans[j].Duration
+	})
+	return spans
+}
+
+// ExpectSlowestSpan ensures that the slowest received span has the given name and that no span with another
+// name has the same duration.
+func (s *MockDatadogServer) ExpectSlowestSpan(t testing.TB, name string) {
+	t.Helper()
+
+	if err := s.CheckSlowestSpan(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckSlowestSpan returns an error unless the slowest received span has the given name and no span with another
+// name has the same duration.
+func (s *MockDatadogServer) CheckSlowestSpan(name string) error {
+	spans := s.slowest()
+	if len(spans) == 0 {
+		return fmt.Errorf("expected slowest span %q, no spans received", name)
+	}
+	for _, span := range spans {
+		if span.Duration < spans[0].Duration {
+			break
+		}
+		if span.Name != name {
+			return fmt.Errorf("expected slowest span %q, got %q with duration %v", name, span.Name, time.Duration(span.Duration))
+		}
+	}
+	return nil
+}
+
+// CriticalPath returns the chain of spans that determines the duration of the trace with the given trace ID. The
+// chain starts at the root that finishes last and repeatedly descends into the child that finishes last.
+func (s *MockDatadogServer) CriticalPath(traceID string) []Span {
+	path := []Span{}
+	nodes := s.GetTraceTree(traceID)
+	for len(nodes) > 0 {
+		last := nodes[0]
+		for _, node := range nodes[1:] {
+			if spanEnd(node.Span) > spanEnd(last.Span) {
+				last = node
+			}
+		}
+		path = append(path, last.Span)
+		nodes = last.Children
+	}
+	return path
+}
+
+// spanEnd returns the time at which the span finished in nanoseconds since the epoch.
+func spanEnd(span Span) int64 {
+	return span.Start + span.Duration
+}
+
+// ExpectCriticalPath ensures that the names of the spans on the critical path of the trace with the given trace ID,
+// as computed by CriticalPath, match the given names in order.
+func (s *MockDatadogServer) ExpectCriticalPath(t testing.TB, traceID string, names ...string) {
+	t.Helper()
+
+	if err := s.CheckCriticalPath(traceID, names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckCriticalPath returns an error unless the names of the spans on the critical path of the trace with the
+// given trace ID match the given names in order.
+func (s *MockDatadogServer) CheckCriticalPath(traceID string, names ...string) error {
+	path := s.CriticalPath(traceID)
+	if len(path) == 0 {
+		return fmt.Errorf("trace %s not found", traceID)
+	}
+
+	actual := make([]string, 0, len(path))
+	for _, span := range path {
+		actual = append(actual, span.Name)
+	}
+	if !slices.Equal(actual, names) {
+		return fmt.Errorf("critical path of trace %s was %v, expected %v", traceID, actual, names)
+	}
+	return nil
+}
+
+// TraceDuration returns the wall-clock duration of the trace with the given 128-bit trace ID, from the earliest
+// Start to the latest end across all of its spans. Spans that run in parallel overlap rather than adding up, so
+// this is the end-to-end time observed by tracing. It is zero when the trace was not received.
+func (s *MockDatadogServer) TraceDuration(traceID string) time.Duration {
+	return traceDuration(s.GetTrace(traceID))
+}
+
+// traceDuration returns the time from the earliest start to the latest end of the spans.
+func traceDuration(spans []Span) time.Duration {
+	if len(spans) == 0 {
+		return 0
+	}
+	start, end := spans[0].Start, spanEnd(spans[0])
+	for _, span := range spans[1:] {
+		start = min(start, span.Start)
+		end = max(end, spanEnd(span))
+	}
+	return time.Duration(end - start)
+}
+
+// ExpectTraceDurationUnder ensures that the trace with the given 128-bit trace ID, as returned by FullTraceID, was
+// received and that its wall-clock duration, as computed by TraceDuration, is below the threshold.
+func (s *MockDatadogServer) ExpectTraceDurationUnder(t testing.TB, traceID string, threshold time.Duration) {
+	t.Helper()
+
+	if err := s.CheckTraceDurationUnder(traceID, threshold); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckTraceDurationUnder returns an error unless the trace with the given 128-bit trace ID was received and its
+// wall-clock duration is below the threshold.
+func (s *MockDatadogServer) CheckTraceDurationUnder(traceID string, threshold time.Duration) error {
+	spans := s.GetTrace(traceID)
+	if len(spans) == 0 {
+		return fmt.Errorf("trace %s not found", traceID)
+	}
+	if duration := traceDuration(spans); duration >= threshold {
+		return fmt.Errorf("trace %s duration %v across %d spans is not under %v", traceID, duration, len(spans), threshold)
+	}
+	return nil
+}
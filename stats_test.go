@@ -0,0 +1,123 @@
+package doghouse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDurationStats(t *testing.T) {
+	s := newMockDatadogServer()
+	for i := 1; i <= 100; i++ {
+		s.store(Span{Name: "request", SpanID: uint64(i), Duration: int64(time.Duration(i) * time.Millisecond)})
+	}
+
+	p50, p90, p99, count := s.DurationStats("request")
+	if p50 != 50*time.Millisecond || p90 != 90*time.Millisecond || p99 != 99*time.Millisecond || count != 100 {
+		t.Fatalf("unexpected stats: p50=%v, p90=%v, p99=%v, count=%d", p50, p90, p99, count)
+	}
+	if _, _, _, count := s.DurationStats("missing"); count != 0 {
+		t.Fatalf("unexpected count for missing span %d", count)
+	}
+
+	s.ExpectP99Under(t, "request", 100*time.Millisecond)
+	if err := s.CheckP99Under("request", 99*time.Millisecond); err == nil {
+		t.Fatal("expected p99 at the threshold to fail")
+	}
+	if err := s.CheckP99Under("missing", time.Second); err == nil {
+		t.Fatal("expected missing span to fail")
+	}
+}
+
+func TestSumMetricAndAvgDuration(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "upload", SpanID: 1, Duration: int64(10 * time.Millisecond), Metrics: map[string]float64{"bytes": 512}})
+	s.store(Span{Name: "upload", SpanID: 2, Duration: int64(20 * time.Millisecond), Metrics: map[string]float64{"bytes": 1024}})
+	s.store(Span{Name: "upload", SpanID: 3, Duration: int64(30 * time.Millisecond)})
+
+	if sum, count := s.SumMetric("upload", "bytes"); sum != 1536 || count != 2 {
+		t.Fatalf("unexpected sum: %v over %d spans", sum, count)
+	}
+	if sum, count := s.SumMetric("missing", "bytes"); sum != 0 || count != 0 {
+		t.Fatalf("unexpected sum for missing span: %v over %d spans", sum, count)
+	}
+	if avg := s.AvgDuration("upload"); avg != 20*time.Millisecond {
+		t.Fatalf("unexpected average duration %v", avg)
+	}
+	if avg := s.AvgDuration("missing"); avg != 0 {
+		t.Fatalf("unexpected average duration for missing span %v", avg)
+	}
+}
+
+func TestSlowestSpans(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "fast", SpanID: 1, Duration: int64(time.Millisecond)})
+	s.store(Span{Name: "slow", SpanID: 2, Duration: int64(time.Second)})
+	s.store(Span{Name: "medium", SpanID: 3, Duration: int64(100 * time.Millisecond)})
+
+	slowest := s.SlowestSpans(2)
+	if len(slowest) != 2 || slowest[0].Name != "slow" || slowest[1].Name != "medium" {
+		t.Fatalf("unexpected slowest spans: %+v", slowest)
+	}
+	if all := s.SlowestSpans(10); len(all) != 3 {
+		t.Fatalf("expected every span, got %+v", all)
+	}
+
+	s.ExpectSlowestSpan(t, "slow")
+	if err := s.CheckSlowestSpan("medium"); err == nil {
+		t.Fatal("expected a faster span to fail")
+	}
+
+	s.store(Span{Name: "tied", SpanID: 4, Duration: int64(time.Second)})
+	if err := s.CheckSlowestSpan("slow"); err == nil {
+		t.Fatal("expected a tie with another span to fail")
+	}
+	if err := newMockDatadogServer().CheckSlowestSpan("slow"); err == nil {
+		t.Fatal("expected no spans to fail")
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "request", SpanID: 1, TraceID: 1, Start: 0, Duration: 100})
+	s.store(Span{Name: "auth", SpanID: 2, TraceID: 1, ParentID: 1, Start: 0, Duration: 20})
+	s.store(Span{Name: "query", SpanID: 3, TraceID: 1, ParentID: 1, Start: 20, Duration: 75})
+	s.store(Span{Name: "cache", SpanID: 4, TraceID: 1, ParentID: 3, Start: 20, Duration: 10})
+	s.store(Span{Name: "scan", SpanID: 5, TraceID: 1, ParentID: 3, Start: 30, Duration: 60})
+
+	path := s.CriticalPath(hexTraceID(1))
+	if len(path) != 3 || path[0].SpanID != 1 || path[1].SpanID != 3 || path[2].SpanID != 5 {
+		t.Fatalf("unexpected critical path: %+v", path)
+	}
+
+	s.ExpectCriticalPath(t, hexTraceID(1), "request", "query", "scan")
+	if err := s.CheckCriticalPath(hexTraceID(1), "request", "auth"); err == nil {
+		t.Fatal("expected mismatched path to fail")
+	}
+	if err := s.CheckCriticalPath(hexTraceID(2)); err == nil {
+		t.Fatal("expected missing trace to fail")
+	}
+}
+
+func TestTraceDuration(t *testing.T) {
+	s := newMockDatadogServer()
+	s.store(Span{Name: "fanout", SpanID: 1, TraceID: 1, Start: 100, Duration: 10})
+	s.store(Span{Name: "worker", SpanID: 2, TraceID: 1, ParentID: 1, Start: 105, Duration: 50})
+	s.store(Span{Name: "worker", SpanID: 3, TraceID: 1, ParentID: 1, Start: 105, Duration: 40})
+	s.store(Span{Name: "other", SpanID: 4, TraceID: 2, Start: 0, Duration: 1000})
+
+	if duration := s.TraceDuration(hexTraceID(1)); duration != 55 {
+		t.Fatalf("unexpected trace duration %v", duration)
+	}
+	if duration := s.TraceDuration(hexTraceID(3)); duration != 0 {
+		t.Fatalf("unexpected duration for missing trace %v", duration)
+	}
+
+	traceID := FullTraceID(Span{TraceID: 1})
+	s.ExpectTraceDurationUnder(t, traceID, 56)
+	if err := s.CheckTraceDurationUnder(traceID, 55); err == nil {
+		t.Fatal("expected a duration at the threshold to fail")
+	}
+	if err := s.CheckTraceDurationUnder(hexTraceID(3), time.Second); err == nil {
+		t.Fatal("expected missing trace to fail")
+	}
+}
@@ -0,0 +1,158 @@
+package doghouse
+
+// SpanStore holds the spans received by a MockDatadogServer. The server serializes every call, so implementations
+// do not need to be safe for concurrent use. Slices returned by a store are only read by the server and may be
+// shared with the store's internal state.
+type SpanStore interface {
+	// Put stores a received span.
+	Put(span Span)
+	// ByName returns the stored spans with the given name in the order they were stored.
+	ByName(name string) []Span
+	// ByID returns the most recently stored span with the given span ID.
+	ByID(spanID uint64) (Span, bool)
+	// All returns every stored span in the order they were stored.
+	All() []Span
+	// Reset removes every stored span.
+	Reset()
+}
+
+// mapStore is the default SpanStore, it retains every span it is given.
+type mapStore struct {
+	spans  []Span
+	byName map[string][]Span
+	byID   map[uint64]Span
+}
+
+// newMapStore returns an empty mapStore.
+func newMapStore() *mapStore {
+	s := &mapStore{}
+	s.Reset()
+	return s
+}
+
+func (s *mapStore) Put(span Span) {
+	s.spans = append(s.spans, span)
+	s.byName[span.Name] = append(s.byName[span.Name], span)
+	s.byID[span.SpanID] = span
+}
+
+func (s *mapStore) ByName(name string) []Span {
+	return s.byName[name]
+}
+
+func (s *mapStore) ByID(spanID uint64) (Span, bool) {
+	span, ok := s.byID[spanID]
+	return span, ok
+}
+
+func (s *mapStore) All() []Span {
+	return s.spans
+}
+
+func (s *mapStore) Reset() {
+	s.spans = nil
+	s.byName = make(map[string][]Span)
+	s.byID = make(map[uint64]Span)
+}
+
+// EvictingStore is a SpanStore that discards spans on its own, such as the one returned by NewRingStore. The server
+// registers a callback with OnEvict so that evicted spans are also dropped from the indices it maintains by
+// service, resource, trace, and parent. Spans must be evicted in the order they were stored.
+type EvictingStore interface {
+	SpanStore
+	OnEvict(callback func(span Span))
+}
+
+// RingStore is a SpanStore that retains only the most recently stored spans, evicting the oldest first.
+type RingStore struct {
+	capacity int
+	ring     []ringEntry
+	oldest   int
+	seq      uint64
+	byName   map[string][]Span
+	byID     map[uint64]ringEntry
+	onEvict  func(span Span)
+}
+
+// ringEntry is a span along with the sequence number it was stored with.
+type ringEntry struct {
+	seq  uint64
+	span Span
+}
+
+// NewRingStore returns a store that retains at most capacity spans, for use with WithStore in long running tests
+// that would otherwise hold every span in memory. Once a span is evicted it is no longer returned by any lookup, so
+// a span whose parent was evicted is reported as an orphan and assertions on its parents fail. SpanCount and the
+// trace and batch counters still count evicted spans.
+func NewRingStore(capacity int) *RingStore {
+	if capacity < 1 {
+		panic("doghouse: ring store capacity must be positive")
+	}
+	s := &RingStore{capacity: capacity}
+	s.Reset()
+	return s
+}
+
+func (s *RingStore) Put(span Span) {
+	s.seq++
+	entry := ringEntry{seq: s.seq, span: span}
+	if len(s.ring) < s.capacity {
+		s.ring = append(s.ring, entry)
+	} else {
+		s.evict(s.ring[s.oldest])
+		s.ring[s.oldest] = entry
+		s.oldest = (s.oldest + 1) % s.capacity
+	}
+	s.byName[span.Name] = append(s.byName[span.Name], span)
+	s.byID[span.SpanID] = entry
+}
+
+// evict drops the oldest span from the indices and notifies the eviction callback.
+func (s *RingStore) evict(entry ringEntry) {
+	dropOldest(s.byName, entry.span.Name)
+	if s.byID[entry.span.SpanID].seq == entry.seq {
+		delete(s.byID, entry.span.SpanID)
+	}
+	if s.onEvict != nil {
+		s.onEvict(entry.span)
+	}
+}
+
+func (s *RingStore) ByName(name string) []Span {
+	return s.byName[name]
+}
+
+func (s *RingStore) ByID(spanID uint64) (Span, bool) {
+	entry, ok := s.byID[spanID]
+	return entry.span, ok
+}
+
+func (s *RingStore) All() []Span {
+	spans := make([]Span, 0, len(s.ring))
+	for i := range s.ring {
+		spans = append(spans, s.ring[(s.oldest+i)%len(s.ring)].span)
+	}
+	return spans
+}
+
+func (s *RingStore) Reset() {
+	s.ring = make([]ringEntry, 0, s.capacity)
+	s.oldest = 0
+	s.byName = make(map[string][]Span)
+	s.byID = make(map[uint64]ringEntry)
+}
+
+// OnEvict sets the callback invoked with each span as it is evicted.
+func (s *RingStore) OnEvict(callback func(span Span)) {
+	s.onEvict = callback
+}
+
+// dropOldest removes the first span stored under the key, deleting the entry once it is empty.
+func dropOldest[K comparable](index map[K][]Span, key K) {
+	spans := index[key]
+	if len(spans) <= 1 {
+		delete(index, key)
+		return
+	}
+	index[key] = spans[1:]
+}
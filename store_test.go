@@ -0,0 +1,63 @@
+package doghouse
+
+import (
+	"testing"
+)
+
+func TestRingStore(t *testing.T) {
+	s := newMockDatadogServer(WithStore(NewRingStore(3)))
+	postBatch(t, s, Batch{{
+		{Name: "root", Service: "web", Resource: "GET /", Start: 1, SpanID: 1, TraceID: 1},
+		{Name: "child", Service: "db", Start: 2, SpanID: 2, TraceID: 1, ParentID: 1},
+		{Name: "child", Service: "db", Start: 3, SpanID: 3, TraceID: 1, ParentID: 1},
+	}})
+	s.ExpectSpan(t, "child", "root")
+
+	postBatch(t, s, Batch{{
+		{Name: "other", Service: "worker", Start: 4, SpanID: 4, TraceID: 2},
+	}})
+
+	if s.HasSpan("root") || len(s.GetSpansByService("web")) != 0 || len(s.GetSpansByResource("GET /")) != 0 {
+		t.Fatal("expected the oldest span to be evicted from every index")
+	}
+	if _, ok := s.spans.ByID(1); ok {
+		t.Fatal("expected the evicted span to be removed from the id index")
+	}
+	if trace := s.GetTrace(hexTraceID(1)); len(trace) != 2 {
+		t.Fatalf("expected evicted span to be removed from its trace, got %+v", trace)
+	}
+	if orphans := s.GetOrphans(); len(orphans) != 2 {
+		t.Fatalf("expected children of the evicted span to be orphans, got %+v", orphans)
+	}
+	if err := s.CheckSpan("child", "root"); err == nil {
+		t.Fatal("expected parent assertion on an evicted parent to fail")
+	}
+	if s.SpanCount() != 4 {
+		t.Fatalf("expected span count to include evicted spans, got %d", s.SpanCount())
+	}
+
+	postBatch(t, s, Batch{{
+		{Name: "other", Service: "worker", Start: 5, SpanID: 5, TraceID: 2},
+		{Name: "other", Service: "worker", Start: 6, SpanID: 6, TraceID: 2},
+	}})
+	if s.HasSpan("child") || len(s.GetTrace(hexTraceID(1))) != 0 || len(s.GetChildren(1)) != 0 {
+		t.Fatal("expected the first trace to be evicted entirely")
+	}
+	if spans := s.Snapshot(); len(spans) != 3 || spans[0].SpanID != 4 || spans[2].SpanID != 6 {
+		t.Fatalf("unexpected spans retained: %+v", spans)
+	}
+}
+
+func TestRingStoreDuplicateIDs(t *testing.T) {
+	store := NewRingStore(2)
+	store.Put(Span{Name: "first", SpanID: 1})
+	store.Put(Span{Name: "second", SpanID: 1})
+	store.Put(Span{Name: "third", SpanID: 2})
+
+	if span, ok := store.ByID(1); !ok || span.Name != "second" {
+		t.Fatalf("expected evicting an overwritten span to keep the newer span, got %+v", span)
+	}
+	if len(store.ByName("first")) != 0 || len(store.All()) != 2 {
+		t.Fatalf("unexpected spans retained: %+v", store.All())
+	}
+}
@@ -0,0 +1,154 @@
+package doghouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+const (
+	telemetryPath         = "/telemetry/proxy/api/v2/apmtelemetry"
+	telemetryMessageBatch = "message-batch"
+)
+
+// TelemetryEvent is a single app telemetry message sent by the tracer, such as app-started or
+// app-integrations-change. The Payload is left encoded since its shape depends on the RequestType.
+type TelemetryEvent struct {
+	APIVersion  string               `json:"api_version"`
+	RequestType string               `json:"request_type"`
+	TracerTime  int64                `json:"tracer_time"`
+	RuntimeID   string               `json:"runtime_id"`
+	SeqID       int64                `json:"seq_id"`
+	Payload     json.RawMessage      `json:"payload"`
+	Application TelemetryApplication `json:"application"`
+}
+
+// TelemetryApplication describes the application that sent a telemetry event.
+type TelemetryApplication struct {
+	ServiceName     string `json:"service_name"`
+	Env             string `json:"env"`
+	ServiceVersion  string `json:"service_version"`
+	TracerVersion   string `json:"tracer_version"`
+	LanguageName    string `json:"language_name"`
+	LanguageVersion string `json:"language_version"`
+}
+
+// TelemetryIntegration is an integration reported in the payload of a telemetry event.
+type TelemetryIntegration struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Enabled bool   `json:"enabled"`
+	Error   string `json:"error"`
+}
+
+// Integrations returns the integrations reported in the event's payload, which is empty for events that do not
+// report integrations.
+func (e TelemetryEvent) Integrations() []TelemetryIntegration {
+	var payload struct {
+		Integrations []TelemetryIntegration `json:"integrations"`
+	}
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		return nil
+	}
+	return payload.Integrations
+}
+
+// EnableTelemetry captures the app telemetry the tracer sends to the agent's telemetry proxy so that it can be
+// inspected with TelemetryEvents. Messages batched into a single message-batch request are recorded as separate
+// events.
+func (s *MockDatadogServer) EnableTelemetry() {
+	s.Handle(telemetryPath, http.HandlerFunc(s.serveTelemetry))
+}
+
+// serveTelemetry decodes and records a telemetry request.
+func (s *MockDatadogServer) serveTelemetry(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Printf("failed to read telemetry body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	events, err := decodeTelemetry(body)
+	if err != nil {
+		s.logger.Printf("failed to parse telemetry: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	s.telemetryEvents = append(s.telemetryEvents, events...)
+	s.lock.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeTelemetry decodes a telemetry request, flattening a message-batch into its messages. Each batched message
+// inherits the envelope of the request it was sent in.
+func decodeTelemetry(body []byte) ([]TelemetryEvent, error) {
+	var event TelemetryEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.RequestType != telemetryMessageBatch {
+		return []TelemetryEvent{event}, nil
+	}
+
+	var messages []struct {
+		RequestType string          `json:"request_type"`
+		Payload     json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(event.Payload, &messages); err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %w", telemetryMessageBatch, err)
+	}
+
+	events := make([]TelemetryEvent, 0, len(messages))
+	for _, message := range messages {
+		batched := event
+		batched.RequestType = message.RequestType
+		batched.Payload = message.Payload
+		events = append(events, batched)
+	}
+	return events, nil
+}
+
+// TelemetryEvents returns every telemetry event received since telemetry was enabled, in the order they arrived.
+func (s *MockDatadogServer) TelemetryEvents() []TelemetryEvent {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]TelemetryEvent(nil), s.telemetryEvents...)
+}
+
+// ExpectTelemetryIntegration ensures that the tracer reported the named integration as enabled.
+func (s *MockDatadogServer) ExpectTelemetryIntegration(t testing.TB, name string) {
+	t.Helper()
+
+	if err := s.CheckTelemetryIntegration(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckTelemetryIntegration returns an error unless the tracer reported the named integration as enabled.
+func (s *MockDatadogServer) CheckTelemetryIntegration(name string) error {
+	reported := []string{}
+	var disabled *TelemetryIntegration
+	for _, event := range s.TelemetryEvents() {
+		for _, integration := range event.Integrations() {
+			if integration.Name != name {
+				reported = append(reported, integration.Name)
+				continue
+			}
+			if integration.Enabled {
+				return nil
+			}
+			disabled = &integration
+		}
+	}
+	if disabled != nil {
+		return fmt.Errorf("telemetry integration %q was reported but not enabled, error: %q", name, disabled.Error)
+	}
+	return fmt.Errorf("telemetry integration %q not reported, found integrations: %v", name, reported)
+}
@@ -0,0 +1,53 @@
+package doghouse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTelemetry(t *testing.T) {
+	s := newMockDatadogServer(WithSilentLogging())
+	s.EnableTelemetry()
+
+	post := func(body string) int {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, telemetryPath, strings.NewReader(body)))
+		return recorder.Code
+	}
+
+	if code := post(`{"api_version":"v2","request_type":"app-started","seq_id":1,"application":{"service_name":"checkout","language_name":"go"},"payload":{}}`); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := post(`{"api_version":"v2","request_type":"message-batch","seq_id":2,"payload":[
+		{"request_type":"app-integrations-change","payload":{"integrations":[{"name":"net/http","enabled":true},{"name":"gorm","enabled":false,"error":"incompatible"}]}},
+		{"request_type":"app-heartbeat","payload":{}}
+	]}`); code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := post("not json"); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status for invalid telemetry %d", code)
+	}
+
+	events := s.TelemetryEvents()
+	if len(events) != 3 || events[0].RequestType != "app-started" || events[0].Application.ServiceName != "checkout" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if events[1].RequestType != "app-integrations-change" || events[1].SeqID != 2 || len(events[1].Integrations()) != 2 {
+		t.Fatalf("unexpected batched event: %+v", events[1])
+	}
+
+	s.ExpectTelemetryIntegration(t, "net/http")
+	if err := s.CheckTelemetryIntegration("gorm"); err == nil || !strings.Contains(err.Error(), "incompatible") {
+		t.Fatalf("expected disabled integration to fail, got %v", err)
+	}
+	if err := s.CheckTelemetryIntegration("grpc"); err == nil {
+		t.Fatal("expected unreported integration to fail")
+	}
+
+	s.Reset()
+	if len(s.TelemetryEvents()) != 0 {
+		t.Fatal("expected telemetry to be cleared by reset")
+	}
+}